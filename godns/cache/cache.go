@@ -1,126 +1,490 @@
 package cache
 
 import (
+	"context"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
 
 	"github.com/google/gopacket/layers"
 )
 
+// Cache holds resolved responses in shards, so lookups of different names
+// rarely wait for each other. With a limit on the entries or their memory,
+// the entries the eviction policy picks make room for new ones; the others
+// stay until they expired and the stale window is over.
 type Cache struct {
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+	entries     int64
+	bytes       int64
+	ticks       uint64
+	sampleStart uint32
+
 	mu            sync.RWMutex
 	cacheLivetime time.Duration
 	cleanup       time.Duration
-	items         map[string]CacheItem
+	staleWindow   time.Duration
+	maxEntries    int64
+	maxBytes      int64
+	policy        EvictionPolicy
+	shards        [shardCount]*cacheShard
+	reconfigured  chan struct{}
 }
 
+// CacheItem holds a whole resolved response for a single (qname, qtype, qclass)
+// key. TTLs of the records are stored as received and are decremented on read.
+// Negative entries (NXDOMAIN and NODATA) keep only the authority section
+// together with the response code. Hits is the number of times the entry was
+// read, this read included.
 type CacheItem struct {
-	RR         layers.DNSResourceRecord
-	Created    time.Time
-	Expiration int64
+	ResponseCode layers.DNSResponseCode
+	Answers      []layers.DNSResourceRecord
+	Authorities  []layers.DNSResourceRecord
+	Additionals  []layers.DNSResourceRecord
+	Created      time.Time
+	Expiration   int64
+	Hits         uint64
+}
+
+// CacheStats are the counters of a cache since it was created, and the number
+// of entries it holds, expired ones included until they are cleaned up, with
+// their approximate size in bytes. Evictions are the entries removed to stay
+// within the limits, Expirations those removed by the cleanup.
+type CacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Size        int
+	Bytes       int64
 }
 
-func (ch *Cache) Add(key []byte, rr layers.DNSResourceRecord, expTime time.Duration) {
-	var expiration int64
+// NewKey builds a cache key for the given question. Names are case-insensitive,
+// so the name is lowercased before it becomes a part of the key.
+func NewKey(name []byte, qtype layers.DNSType, qclass layers.DNSClass) []byte {
+	key := []byte(strings.ToLower(strings.TrimSuffix(string(name), ".")))
+	var suffix [4]byte
+	binary.BigEndian.PutUint16(suffix[:2], uint16(qtype))
+	binary.BigEndian.PutUint16(suffix[2:], uint16(qclass))
+	return append(key, suffix[:]...)
+}
 
+// Add stores the RRsets of a response. The entry lives as long as the smallest
+// TTL among its records, clamped by the cache livetime if one is configured.
+// Responses with a zero TTL are not cached at all.
+func (ch *Cache) Add(key []byte, answers, authorities, additionals []layers.DNSResourceRecord) {
+	item := CacheItem{
+		ResponseCode: layers.DNSResponseCodeNoErr,
+		Answers:      copyRecords(answers),
+		Authorities:  copyRecords(authorities),
+		Additionals:  copyRecords(additionals),
+	}
+	ch.store(key, item, MinTTL(item.Answers, item.Authorities, item.Additionals))
+}
+
+// AddNegative stores an NXDOMAIN or NODATA response as described in RFC 2308.
+// The negative TTL is the minimum of the SOA TTL and the SOA MINIMUM field.
+// The authority section is kept with TTLs no larger than that, so the SOA and
+// any NSEC records proving the denial can be served back to clients. Answers
+// are the CNAME chain that led to the missing name, if there was one.
+// Responses without an SOA in the authority section are not cached.
+func (ch *Cache) AddNegative(key []byte, rcode layers.DNSResponseCode, answers, authorities []layers.DNSResourceRecord) {
+	records := copyRecords(authorities)
+	for _, rr := range records {
+		if rr.Type != layers.DNSTypeSOA {
+			continue
+		}
+		negativeTTL := rr.TTL
+		if rr.SOA.Minimum < negativeTTL {
+			negativeTTL = rr.SOA.Minimum
+		}
+		for i := range records {
+			if records[i].TTL > negativeTTL {
+				records[i].TTL = negativeTTL
+			}
+		}
+		item := CacheItem{
+			ResponseCode: rcode,
+			Answers:      copyRecords(answers),
+			Authorities:  records,
+		}
+		ttl := negativeTTL
+		if len(item.Answers) > 0 && MinTTL(item.Answers) < ttl {
+			ttl = MinTTL(item.Answers)
+		}
+		ch.store(key, item, ttl)
+		return
+	}
+}
+
+func (ch *Cache) store(key []byte, item CacheItem, ttl uint32) {
+	item.Created = time.Now()
 	hashedKey := hashFromBytes(key)
 
-	if expTime == 0 {
-		expTime = ch.cacheLivetime
+	ch.mu.RLock()
+	cacheLivetime := ch.cacheLivetime
+	ch.mu.RUnlock()
+
+	expTime := time.Duration(ttl) * time.Second
+	if cacheLivetime > 0 && expTime > cacheLivetime {
+		expTime = cacheLivetime
 	}
-	if expTime > 0 {
-		expiration = time.Now().Add(expTime).UnixNano()
+	if expTime <= 0 {
+		return
 	}
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	item.Expiration = item.Created.Add(expTime).UnixNano()
+	ch.put(hashedKey, item)
+}
 
-	ch.items[hashedKey] = CacheItem{
-		RR:         rr,
-		Expiration: expiration,
-		Created:    time.Now(),
+// put adds an item under its hashed key and evicts other entries if the cache
+// went over a limit.
+func (ch *Cache) put(hashedKey string, item CacheItem) {
+	entry := &cacheEntry{
+		key:  hashedKey,
+		item: item,
+		size: getEntrySize(hashedKey, item),
+		hits: item.Hits,
+		used: atomic.AddUint64(&ch.ticks, 1),
 	}
+	shard := ch.shards[getShardIndex(hashedKey)]
+	shard.mu.Lock()
+	count, size := shard.put(entry)
+	shard.mu.Unlock()
+
+	atomic.AddInt64(&ch.entries, count)
+	atomic.AddInt64(&ch.bytes, size)
+	ch.evict(entry)
 }
 
-func NewCache(defaultExpiration, cleanupInterval time.Duration) *Cache {
-	items := make(map[string]CacheItem)
+// evict removes entries until the cache is within its limits. Each time the
+// candidates of evictionSamples shards, taken in turn, are compared, and the
+// entry the policy picks among them goes. Only one shard is locked at a time.
+// The entry keep, just added, stays.
+func (ch *Cache) evict(keep *cacheEntry) {
+	ch.mu.RLock()
+	policy := ch.policy
+	ch.mu.RUnlock()
+
+	for ch.overLimits() {
+		var victim *cacheShard
+		var victimRank entryRank
+		start := int(atomic.AddUint32(&ch.sampleStart, 1))
+		sampled := 0
+		for i := 0; i < shardCount && sampled < evictionSamples; i++ {
+			shard := ch.shards[(start+i)%shardCount]
+			shard.mu.Lock()
+			if entry := shard.candidate(keep); entry != nil {
+				sampled++
+				if rank := entry.rank(); victim == nil || policy.evictsBefore(rank, victimRank) {
+					victim, victimRank = shard, rank
+				}
+			}
+			shard.mu.Unlock()
+		}
+		if victim == nil {
+			return
+		}
+
+		victim.mu.Lock()
+		entry := victim.candidate(keep)
+		if entry != nil {
+			victim.remove(entry)
+		}
+		victim.mu.Unlock()
+		if entry != nil {
+			atomic.AddInt64(&ch.entries, -1)
+			atomic.AddInt64(&ch.bytes, -entry.size)
+			atomic.AddUint64(&ch.evictions, 1)
+		}
+	}
+}
+
+func (ch *Cache) overLimits() bool {
+	ch.mu.RLock()
+	maxEntries, maxBytes := ch.maxEntries, ch.maxBytes
+	ch.mu.RUnlock()
+	return maxEntries > 0 && atomic.LoadInt64(&ch.entries) > maxEntries ||
+		maxBytes > 0 && atomic.LoadInt64(&ch.bytes) > maxBytes
+}
+
+// NewCache creates an unlimited cache. Its cleanup runs until ctx is done.
+func NewCache(defaultExpiration, cleanupInterval time.Duration, ctx context.Context) *Cache {
 	cache := Cache{
-		items:         items,
 		cacheLivetime: defaultExpiration,
 		cleanup:       cleanupInterval,
+		reconfigured:  make(chan struct{}, 1),
 	}
-
-	if cleanupInterval > 0 {
-		cache.StartGC()
+	for i := range cache.shards {
+		cache.shards[i] = newCacheShard()
 	}
+
+	cache.StartGC(ctx)
 	return &cache
 }
 
-func (ch *Cache) GetItem(key []byte) (layers.DNSResourceRecord, bool) {
+// Configure changes the longest time entries may live, the interval of the
+// cleanup and how long expired entries are kept for GetStaleItem while the
+// cache is in use. Entries that would now live too long are cut short.
+func (ch *Cache) Configure(defaultExpiration, cleanupInterval, staleWindow time.Duration) {
+	ch.mu.Lock()
+	ch.cacheLivetime = defaultExpiration
+	ch.cleanup = cleanupInterval
+	ch.staleWindow = staleWindow
+	ch.mu.Unlock()
+
+	if defaultExpiration > 0 {
+		for _, shard := range ch.shards {
+			shard.mu.Lock()
+			for _, entry := range shard.entries {
+				if latest := entry.item.Created.Add(defaultExpiration).UnixNano(); entry.item.Expiration > latest {
+					entry.item.Expiration = latest
+				}
+			}
+			shard.mu.Unlock()
+		}
+	}
+
+	select {
+	case ch.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+// SetLimits changes the most entries the cache holds, the most memory they
+// take in bytes, both unlimited if zero, and the policy that picks the
+// entries to evict. Entries over the new limits are evicted right away.
+func (ch *Cache) SetLimits(maxEntries int64, maxBytes int64, policy EvictionPolicy) {
+	ch.mu.Lock()
+	ch.maxEntries = maxEntries
+	ch.maxBytes = maxBytes
+	ch.policy = policy
+	ch.mu.Unlock()
+
+	for _, shard := range ch.shards {
+		shard.mu.Lock()
+		shard.setPolicy(policy)
+		shard.mu.Unlock()
+	}
+	ch.evict(nil)
+}
+
+// GetItem returns a cached response with the TTLs of all records reduced by
+// the time the entry has already spent in the cache.
+func (ch *Cache) GetItem(key []byte) (CacheItem, bool) {
+	hashedKey := hashFromBytes(key)
+	shard := ch.shards[getShardIndex(hashedKey)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry, found := shard.entries[hashedKey]
+	now := time.Now()
+	if !found || now.UnixNano() > entry.item.Expiration {
+		atomic.AddUint64(&ch.misses, 1)
+		return CacheItem{}, false
+	}
+	atomic.AddUint64(&ch.hits, 1)
+	shard.touch(entry, atomic.AddUint64(&ch.ticks, 1))
+
+	item := entry.item
+	item.Hits = entry.hits
+	elapsed := uint32(now.Sub(item.Created) / time.Second)
+	item.Answers = decrementTTL(item.Answers, elapsed)
+	item.Authorities = decrementTTL(item.Authorities, elapsed)
+	item.Additionals = decrementTTL(item.Additionals, elapsed)
+	return item, true
+}
+
+// GetStaleItem returns a response that expired no longer ago than the stale
+// window, with the TTLs of all records set to ttl (RFC 8767). Entries that are
+// still fresh are left to GetItem.
+func (ch *Cache) GetStaleItem(key []byte, ttl uint32) (CacheItem, bool) {
 	ch.mu.RLock()
-	defer ch.mu.RLock()
+	staleWindow := ch.staleWindow
+	ch.mu.RUnlock()
 
 	hashedKey := hashFromBytes(key)
+	shard := ch.shards[getShardIndex(hashedKey)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	item, found := ch.items[hashedKey]
+	entry, found := shard.entries[hashedKey]
 	if !found {
-		return layers.DNSResourceRecord{}, false
+		return CacheItem{}, false
 	}
-	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
-			return layers.DNSResourceRecord{}, false
-		}
+	now := time.Now().UnixNano()
+	if now <= entry.item.Expiration || now > entry.item.Expiration+int64(staleWindow) {
+		return CacheItem{}, false
 	}
-	return item.RR, true
+	shard.touch(entry, atomic.AddUint64(&ch.ticks, 1))
+
+	item := entry.item
+	item.Hits = entry.hits
+	item.Answers = setTTL(item.Answers, ttl)
+	item.Authorities = setTTL(item.Authorities, ttl)
+	item.Additionals = setTTL(item.Additionals, ttl)
+	return item, true
 }
 
 func (ch *Cache) DeleteItem(key []byte) {
 
 	hashedKey := hashFromBytes(key)
+	shard := ch.shards[getShardIndex(hashedKey)]
 
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-	_, found := ch.items[hashedKey]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, found := shard.entries[hashedKey]
 	if found {
-		delete(ch.items, hashedKey)
+		shard.remove(entry)
+		atomic.AddInt64(&ch.entries, -1)
+		atomic.AddInt64(&ch.bytes, -entry.size)
 	}
 }
 
-func (ch *Cache) StartGC() {
-	go ch.GC()
+func (ch *Cache) StartGC(ctx context.Context) {
+	go ch.GC(ctx)
 }
 
-func (ch *Cache) GC() {
+// GC removes the entries that expired longer ago than the stale window every
+// cleanup interval, until ctx is done. A zero interval pauses it until the
+// cache is configured again.
+func (ch *Cache) GC(ctx context.Context) {
 	for {
-		<-time.After(ch.cleanup)
-		if ch.items == nil {
+		ch.mu.RLock()
+		cleanup := ch.cleanup
+		ch.mu.RUnlock()
+
+		var tick <-chan time.Time
+		if cleanup > 0 {
+			tick = time.After(cleanup)
+		}
+		select {
+		case <-ctx.Done():
 			return
+		case <-tick:
+		case <-ch.reconfigured:
+			continue
 		}
-		if expKeys := ch.getExpiredKeys(); len(expKeys) != 0 {
-			ch.removeExpiredKeys(expKeys)
+
+		for _, shard := range ch.shards {
+			ch.removeExpired(shard)
 		}
 	}
 }
 
-func (ch *Cache) getExpiredKeys() (expKeys []string) {
+func (ch *Cache) removeExpired(shard *cacheShard) {
 	ch.mu.RLock()
-	defer ch.mu.RUnlock()
-	for k, item := range ch.items {
-		if time.Now().UnixNano() > item.Expiration && item.Expiration > 0 {
-			expKeys = append(expKeys, k)
+	expired := time.Now().UnixNano() - int64(ch.staleWindow)
+	ch.mu.RUnlock()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	for _, entry := range shard.entries {
+		if entry.item.Expiration < expired {
+			shard.remove(entry)
+			atomic.AddInt64(&ch.entries, -1)
+			atomic.AddInt64(&ch.bytes, -entry.size)
+			atomic.AddUint64(&ch.expirations, 1)
 		}
 	}
-	return expKeys
 }
 
-func (ch *Cache) removeExpiredKeys(expKeys []string) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-	for _, k := range expKeys {
-		delete(ch.items, k)
+// Stats returns the hit, miss, eviction and expiration counters and the
+// current size.
+func (ch *Cache) Stats() CacheStats {
+	return CacheStats{
+		Hits:        atomic.LoadUint64(&ch.hits),
+		Misses:      atomic.LoadUint64(&ch.misses),
+		Evictions:   atomic.LoadUint64(&ch.evictions),
+		Expirations: atomic.LoadUint64(&ch.expirations),
+		Size:        int(atomic.LoadInt64(&ch.entries)),
+		Bytes:       atomic.LoadInt64(&ch.bytes),
+	}
+}
+
+// MinTTL returns the smallest TTL among the given records. OPT pseudo-records
+// carry flags in their TTL field and are skipped.
+func MinTTL(sections ...[]layers.DNSResourceRecord) uint32 {
+	var minTTL uint32
+	var found bool
+	for _, records := range sections {
+		for _, rr := range records {
+			if rr.Type == layers.DNSTypeOPT {
+				continue
+			}
+			if !found || rr.TTL < minTTL {
+				minTTL = rr.TTL
+				found = true
+			}
+		}
+	}
+	return minTTL
+}
+
+// copyRecords detaches records from the packet buffers they were decoded from
+// and drops OPT pseudo-records, which belong to a single message only.
+func copyRecords(records []layers.DNSResourceRecord) []layers.DNSResourceRecord {
+	var copied []layers.DNSResourceRecord
+	for _, rr := range records {
+		if rr.Type == layers.DNSTypeOPT {
+			continue
+		}
+		rr.Name = append([]byte(nil), rr.Name...)
+		rr.Data = append([]byte(nil), rr.Data...)
+		rr.IP = append([]byte(nil), rr.IP...)
+		rr.NS = append([]byte(nil), rr.NS...)
+		rr.CNAME = append([]byte(nil), rr.CNAME...)
+		rr.PTR = append([]byte(nil), rr.PTR...)
+		rr.TXT = append([]byte(nil), rr.TXT...)
+		rr.SOA.MName = append([]byte(nil), rr.SOA.MName...)
+		rr.SOA.RName = append([]byte(nil), rr.SOA.RName...)
+		rr.MX.Name = append([]byte(nil), rr.MX.Name...)
+		rr.SRV.Name = append([]byte(nil), rr.SRV.Name...)
+		txts := make([][]byte, 0, len(rr.TXTs))
+		for _, txt := range rr.TXTs {
+			txts = append(txts, append([]byte(nil), txt...))
+		}
+		rr.TXTs = txts
+		copied = append(copied, rr)
+	}
+	return copied
+}
+
+// Lifetime returns how long the entry lives in the cache, and how much of that
+// is left at now.
+func (item CacheItem) Lifetime(now time.Time) (total time.Duration, left time.Duration) {
+	total = time.Duration(item.Expiration - item.Created.UnixNano())
+	left = time.Duration(item.Expiration - now.UnixNano())
+	return total, left
+}
+
+func decrementTTL(records []layers.DNSResourceRecord, elapsed uint32) []layers.DNSResourceRecord {
+	decremented := make([]layers.DNSResourceRecord, len(records))
+	for i, rr := range records {
+		if rr.TTL > elapsed {
+			rr.TTL -= elapsed
+		} else {
+			rr.TTL = 0
+		}
+		decremented[i] = rr
+	}
+	return decremented
+}
+
+func setTTL(records []layers.DNSResourceRecord, ttl uint32) []layers.DNSResourceRecord {
+	updated := make([]layers.DNSResourceRecord, len(records))
+	for i, rr := range records {
+		rr.TTL = ttl
+		updated[i] = rr
 	}
+	return updated
 }
 
 func hashFromBytes(bytes []byte) string {
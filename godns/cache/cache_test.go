@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func newTestCache(t *testing.T, defaultExpiration time.Duration) *Cache {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewCache(defaultExpiration, time.Minute, ctx)
+}
+
+func getTestRecord(name string, ttl uint32) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  layers.DNSTypeA,
+		Class: layers.DNSClassIN,
+		TTL:   ttl,
+		IP:    net.IPv4(10, 0, 0, 1),
+	}
+}
+
+// age moves the entry under key back in time, as if it was cached elapsed
+// earlier.
+func age(ch *Cache, key []byte, elapsed time.Duration) {
+	hashedKey := hashFromBytes(key)
+	shard := ch.shards[getShardIndex(hashedKey)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry := shard.entries[hashedKey]
+	entry.item.Created = entry.item.Created.Add(-elapsed)
+	entry.item.Expiration -= int64(elapsed)
+}
+
+func TestRepeatedLookupHits(t *testing.T) {
+	ch := newTestCache(t, 0)
+	key := NewKey([]byte("www.example.test"), layers.DNSTypeA, layers.DNSClassIN)
+
+	if _, found := ch.GetItem(key); found {
+		t.Fatal("found an entry in an empty cache")
+	}
+	ch.Add(key, []layers.DNSResourceRecord{getTestRecord("www.example.test", 300)}, nil, nil)
+	for i := uint64(1); i <= 2; i++ {
+		item, found := ch.GetItem(NewKey([]byte("WWW.Example.Test."), layers.DNSTypeA, layers.DNSClassIN))
+		if !found {
+			t.Fatalf("lookup %d missed", i)
+		}
+		if item.Hits != i {
+			t.Errorf("lookup %d got %d hits", i, item.Hits)
+		}
+	}
+
+	stats := ch.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Size != 1 {
+		t.Errorf("got %d hits, %d misses and %d entries, want 2, 1 and 1", stats.Hits, stats.Misses, stats.Size)
+	}
+}
+
+func TestTTLsCountDown(t *testing.T) {
+	ch := newTestCache(t, 0)
+	key := NewKey([]byte("www.example.test"), layers.DNSTypeA, layers.DNSClassIN)
+	ch.Add(key, []layers.DNSResourceRecord{
+		getTestRecord("www.example.test", 300),
+		getTestRecord("www.example.test", 600),
+	}, nil, nil)
+
+	age(ch, key, 100*time.Second)
+	item, found := ch.GetItem(key)
+	if !found {
+		t.Fatal("the entry expired before its TTL")
+	}
+	if item.Answers[0].TTL != 200 || item.Answers[1].TTL != 500 {
+		t.Errorf("got TTLs %d and %d, want 200 and 500", item.Answers[0].TTL, item.Answers[1].TTL)
+	}
+
+	age(ch, key, 201*time.Second)
+	if _, found := ch.GetItem(key); found {
+		t.Error("the entry outlived the smallest TTL")
+	}
+}
+
+func TestNegativeTTLCountsDown(t *testing.T) {
+	ch := newTestCache(t, 0)
+	key := NewKey([]byte("missing.example.test"), layers.DNSTypeA, layers.DNSClassIN)
+	ch.AddNegative(key, layers.DNSResponseCodeNXDomain, nil, []layers.DNSResourceRecord{{
+		Name:  []byte("example.test"),
+		Type:  layers.DNSTypeSOA,
+		Class: layers.DNSClassIN,
+		TTL:   3600,
+		SOA:   layers.DNSSOA{MName: []byte("ns.example.test"), RName: []byte("admin.example.test"), Minimum: 60},
+	}})
+
+	age(ch, key, 20*time.Second)
+	item, found := ch.GetItem(key)
+	if !found {
+		t.Fatal("the negative entry is not cached")
+	}
+	if item.ResponseCode != layers.DNSResponseCodeNXDomain || item.Authorities[0].TTL != 40 {
+		t.Errorf("got %v with SOA TTL %d, want NXDomain with 40", item.ResponseCode, item.Authorities[0].TTL)
+	}
+}
+
+func TestCacheLivetimeLimitsTTL(t *testing.T) {
+	ch := newTestCache(t, time.Minute)
+	key := NewKey([]byte("www.example.test"), layers.DNSTypeA, layers.DNSClassIN)
+	ch.Add(key, []layers.DNSResourceRecord{getTestRecord("www.example.test", 300)}, nil, nil)
+
+	age(ch, key, 61*time.Second)
+	if _, found := ch.GetItem(key); found {
+		t.Error("the entry outlived the cache livetime")
+	}
+}
+
+func addTestEntry(ch *Cache, name string) []byte {
+	key := NewKey([]byte(name), layers.DNSTypeA, layers.DNSClassIN)
+	ch.Add(key, []layers.DNSResourceRecord{getTestRecord(name, 300)}, nil, nil)
+	return key
+}
+
+// checkCached reports the names that are not cached, or cached though they
+// should have been evicted. It counts as a hit for each name found.
+func checkCached(t *testing.T, ch *Cache, names map[string]bool) {
+	t.Helper()
+	for name, want := range names {
+		if _, found := ch.GetItem(NewKey([]byte(name), layers.DNSTypeA, layers.DNSClassIN)); found != want {
+			t.Errorf("%s: cached is %v, want %v", name, found, want)
+		}
+	}
+}
+
+// With no more than four names, the sampled shards hold every candidate, so
+// the policies evict in their exact order.
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	ch := newTestCache(t, 0)
+	ch.SetLimits(3, 0, EvictLRU)
+	a := addTestEntry(ch, "a.example.test")
+	addTestEntry(ch, "b.example.test")
+	addTestEntry(ch, "c.example.test")
+	ch.GetItem(a)
+	addTestEntry(ch, "d.example.test")
+
+	checkCached(t, ch, map[string]bool{
+		"a.example.test": true,
+		"b.example.test": false,
+		"c.example.test": true,
+		"d.example.test": true,
+	})
+}
+
+func TestLFUEvictsLeastFrequentlyUsed(t *testing.T) {
+	ch := newTestCache(t, 0)
+	ch.SetLimits(3, 0, EvictLFU)
+	a := addTestEntry(ch, "a.example.test")
+	b := addTestEntry(ch, "b.example.test")
+	c := addTestEntry(ch, "c.example.test")
+	// LRU would evict a, which was used before the others.
+	for _, key := range [][]byte{a, a, b, b, b, c} {
+		ch.GetItem(key)
+	}
+	addTestEntry(ch, "d.example.test")
+
+	checkCached(t, ch, map[string]bool{
+		"a.example.test": true,
+		"b.example.test": true,
+		"c.example.test": false,
+		"d.example.test": true,
+	})
+}
+
+func TestEntryLimit(t *testing.T) {
+	ch := newTestCache(t, 0)
+	for i := 0; i < 100; i++ {
+		addTestEntry(ch, fmt.Sprintf("host%d.example.test", i))
+	}
+	ch.SetLimits(10, 0, EvictLRU)
+	if stats := ch.Stats(); stats.Size != 10 || stats.Evictions != 90 {
+		t.Errorf("lowering the limit left %d entries after %d evictions, want 10 and 90", stats.Size, stats.Evictions)
+	}
+
+	for i := 100; i < 200; i++ {
+		addTestEntry(ch, fmt.Sprintf("host%d.example.test", i))
+	}
+	stats := ch.Stats()
+	if stats.Size != 10 || stats.Evictions != 190 {
+		t.Errorf("got %d entries after %d evictions, want 10 and 190", stats.Size, stats.Evictions)
+	}
+	checkCached(t, ch, map[string]bool{"host199.example.test": true})
+}
+
+func TestMemoryLimit(t *testing.T) {
+	// The names are of the same length, so every entry takes as much.
+	ch := newTestCache(t, 0)
+	addTestEntry(ch, "host00.example.test")
+	entrySize := ch.Stats().Bytes
+	ch.SetLimits(0, 5*entrySize, EvictLRU)
+
+	for i := 1; i < 50; i++ {
+		addTestEntry(ch, fmt.Sprintf("host%02d.example.test", i))
+		if stats := ch.Stats(); stats.Bytes > 5*entrySize {
+			t.Fatalf("the entries take %d bytes over the limit of %d", stats.Bytes, 5*entrySize)
+		}
+	}
+	stats := ch.Stats()
+	if stats.Size != 5 || stats.Evictions != 45 {
+		t.Errorf("got %d entries after %d evictions, want 5 and 45", stats.Size, stats.Evictions)
+	}
+	checkCached(t, ch, map[string]bool{"host49.example.test": true})
+
+	// The evicted entries no longer count.
+	if got := ch.Stats().Bytes; got != 5*entrySize {
+		t.Errorf("the cache counts %d bytes for 5 entries of %d", got, entrySize)
+	}
+}
@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"unsafe"
+
+	"github.com/google/gopacket/layers"
+)
+
+// shardCount is the number of shards the entries are spread over, each with
+// its own lock.
+const shardCount = 32
+
+// evictionSamples is the number of shards whose candidates are compared to
+// find the next entry to evict. Empty shards are skipped and not counted.
+const evictionSamples = 4
+
+// Approximate memory taken by an entry besides its records, and by a record
+// besides its data: the map slot, the entry itself and the slice headers.
+const (
+	entryOverhead  = 256
+	recordOverhead = int64(unsafe.Sizeof(layers.DNSResourceRecord{}))
+)
+
+// EvictionPolicy chooses the entries that make room when the cache is full.
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the entry that was used the longest time ago.
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU evicts the entry with the fewest hits, the least recently used
+	// of those on a tie.
+	EvictLFU
+)
+
+// ParseEvictionPolicy reads an eviction policy name from the config. An empty
+// name is LRU.
+func ParseEvictionPolicy(name string) (EvictionPolicy, bool) {
+	switch name {
+	case "", "lru":
+		return EvictLRU, true
+	case "lfu":
+		return EvictLFU, true
+	}
+	return EvictLRU, false
+}
+
+// entryRank is what an eviction policy compares entries by.
+type entryRank struct {
+	hits uint64
+	used uint64
+}
+
+// evictsBefore reports whether the policy evicts an entry of rank a before
+// one of rank b.
+func (policy EvictionPolicy) evictsBefore(a, b entryRank) bool {
+	if policy == EvictLFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.used < b.used
+}
+
+// cacheEntry is an item in a shard, with what the eviction policy needs to
+// know about it.
+type cacheEntry struct {
+	key   string
+	item  CacheItem
+	size  int64
+	hits  uint64
+	used  uint64
+	index int
+}
+
+func (entry *cacheEntry) rank() entryRank {
+	return entryRank{entry.hits, entry.used}
+}
+
+// cacheShard holds the entries whose hashed key falls into it. The entries
+// are also kept in a heap with the next one to evict on top.
+type cacheShard struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	order   evictionOrder
+}
+
+func newCacheShard() *cacheShard {
+	return &cacheShard{entries: make(map[string]*cacheEntry)}
+}
+
+// put adds entry, replacing the one with the same key. It returns the change
+// in the number of entries and in their size.
+func (shard *cacheShard) put(entry *cacheEntry) (int64, int64) {
+	var count, size int64 = 1, entry.size
+	if old, found := shard.entries[entry.key]; found {
+		heap.Remove(&shard.order, old.index)
+		count, size = 0, entry.size-old.size
+	}
+	shard.entries[entry.key] = entry
+	heap.Push(&shard.order, entry)
+	return count, size
+}
+
+func (shard *cacheShard) remove(entry *cacheEntry) {
+	delete(shard.entries, entry.key)
+	heap.Remove(&shard.order, entry.index)
+}
+
+// touch records a hit on entry at the tick used.
+func (shard *cacheShard) touch(entry *cacheEntry, used uint64) {
+	entry.hits++
+	entry.used = used
+	heap.Fix(&shard.order, entry.index)
+}
+
+// candidate returns the entry the policy wants gone, unless it is keep; then
+// the next one in line. It returns nil if there is no such entry.
+func (shard *cacheShard) candidate(keep *cacheEntry) *cacheEntry {
+	if len(shard.order.entries) == 0 {
+		return nil
+	}
+	victim := 0
+	if shard.order.entries[0] == keep {
+		victim = -1
+		for i := 1; i < 3 && i < len(shard.order.entries); i++ {
+			if victim < 0 || shard.order.Less(i, victim) {
+				victim = i
+			}
+		}
+	}
+	if victim < 0 {
+		return nil
+	}
+	return shard.order.entries[victim]
+}
+
+// setPolicy reorders the entries for another eviction policy.
+func (shard *cacheShard) setPolicy(policy EvictionPolicy) {
+	if shard.order.policy == policy {
+		return
+	}
+	shard.order.policy = policy
+	heap.Init(&shard.order)
+}
+
+// evictionOrder is a heap of entries, the one to evict first on top.
+type evictionOrder struct {
+	entries []*cacheEntry
+	policy  EvictionPolicy
+}
+
+func (order *evictionOrder) Len() int { return len(order.entries) }
+
+func (order *evictionOrder) Less(i, j int) bool {
+	return order.policy.evictsBefore(order.entries[i].rank(), order.entries[j].rank())
+}
+
+func (order *evictionOrder) Swap(i, j int) {
+	order.entries[i], order.entries[j] = order.entries[j], order.entries[i]
+	order.entries[i].index = i
+	order.entries[j].index = j
+}
+
+func (order *evictionOrder) Push(x interface{}) {
+	entry := x.(*cacheEntry)
+	entry.index = len(order.entries)
+	order.entries = append(order.entries, entry)
+}
+
+func (order *evictionOrder) Pop() interface{} {
+	last := len(order.entries) - 1
+	entry := order.entries[last]
+	order.entries[last] = nil
+	order.entries = order.entries[:last]
+	return entry
+}
+
+// getShardIndex spreads the hashed keys over the shards with FNV-1a.
+func getShardIndex(hashedKey string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(hashedKey); i++ {
+		hash ^= uint32(hashedKey[i])
+		hash *= 16777619
+	}
+	return int(hash % shardCount)
+}
+
+// getEntrySize estimates the memory an entry takes.
+func getEntrySize(key string, item CacheItem) int64 {
+	size := int64(entryOverhead + len(key))
+	for _, records := range [][]layers.DNSResourceRecord{item.Answers, item.Authorities, item.Additionals} {
+		for _, rr := range records {
+			size += recordOverhead + int64(len(rr.Name)+len(rr.Data)+len(rr.IP)+len(rr.NS)+
+				len(rr.CNAME)+len(rr.PTR)+len(rr.TXT)+len(rr.SOA.MName)+len(rr.SOA.RName)+
+				len(rr.MX.Name)+len(rr.SRV.Name))
+			for _, txt := range rr.TXTs {
+				size += int64(len(txt)) + int64(unsafe.Sizeof(txt))
+			}
+		}
+	}
+	return size
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot file starts with snapshotMagic and the format version as a
+// big-endian uint32, followed by the gob encoded entries. Files of another
+// version are not loaded, so the format can change without misreading old
+// files.
+const (
+	snapshotMagic   = "godns-cache\n"
+	snapshotVersion = 1
+)
+
+// Save writes the entries that have not expired yet, or are still in the
+// stale window, to path. The snapshot is written to a temporary file first
+// and renamed over path, so a crash never leaves a partial snapshot behind.
+func (ch *Cache) Save(path string) (int, error) {
+	ch.mu.RLock()
+	expired := time.Now().UnixNano() - int64(ch.staleWindow)
+	ch.mu.RUnlock()
+
+	items := make(map[string]CacheItem)
+	for _, shard := range ch.shards {
+		shard.mu.Lock()
+		for k, entry := range shard.entries {
+			if entry.item.Expiration > expired {
+				item := entry.item
+				item.Hits = entry.hits
+				items[k] = item
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	var version [4]byte
+	binary.BigEndian.PutUint32(version[:], snapshotVersion)
+	writer.WriteString(snapshotMagic)
+	writer.Write(version[:])
+	if err := gob.NewEncoder(writer).Encode(items); err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	return len(items), os.Rename(file.Name(), path)
+}
+
+// Load adds the entries of the snapshot at path to the cache. Entries that
+// expired since the snapshot was written, beyond the stale window, are
+// dropped. The others keep the time they were cached at, so their TTLs count
+// the time the server was down as well.
+func (ch *Cache) Load(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, len(snapshotMagic)+4)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, errors.New("not a cache snapshot")
+	}
+	if version := binary.BigEndian.Uint32(header[len(snapshotMagic):]); version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	var items map[string]CacheItem
+	if err := gob.NewDecoder(reader).Decode(&items); err != nil {
+		return 0, err
+	}
+
+	ch.mu.RLock()
+	cacheLivetime := ch.cacheLivetime
+	expired := time.Now().UnixNano() - int64(ch.staleWindow)
+	ch.mu.RUnlock()
+
+	loaded := 0
+	for k, item := range items {
+		if cacheLivetime > 0 {
+			if latest := item.Created.Add(cacheLivetime).UnixNano(); item.Expiration > latest {
+				item.Expiration = latest
+			}
+		}
+		if item.Expiration <= expired {
+			continue
+		}
+		shard := ch.shards[getShardIndex(k)]
+		shard.mu.Lock()
+		_, found := shard.entries[k]
+		shard.mu.Unlock()
+		if !found {
+			ch.put(k, item)
+			loaded++
+		}
+	}
+	return loaded, nil
+}
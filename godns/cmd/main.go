@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"fmt"
 	. "godns/cache"
 	. "godns/cmd/utils"
 	. "godns/config"
+	. "godns/logger"
 	. "godns/server"
 	"time"
 )
@@ -14,33 +14,29 @@ func main() {
 
 	mainContext, shutdown := context.WithCancel(context.Background())
 
-	go StartShutdownHandler(shutdown)
-
 	var configPath string = GetConfigPath()
 
 	var configHandler *ConfigHandler = NewConfigHandler(configPath, mainContext)
+
+	go StartSignalHandler(shutdown, configHandler.RequestReload)
+
 	var cache *Cache = NewCache(time.Minute*configHandler.Get().CacheExpiration,
-		time.Minute*configHandler.Get().CacheCleanup)
+		time.Minute*configHandler.Get().CacheCleanup, mainContext)
 
-	fmt.Println(time.Minute * configHandler.Get().CacheExpiration)
+	Debugf("Cache entries live for at most %s", time.Minute*configHandler.Get().CacheExpiration)
 
-	go StartServer(configHandler, mainContext, cache)
+	StartServer(configHandler, mainContext, cache)
 
 	for {
 		select {
 		case <-mainContext.Done():
+			SaveCache(configHandler, cache)
 			time.Sleep(time.Second / 2)
-			fmt.Print("\033[32mDNS Server was stopped\n\033[0m")
+			Infof("DNS Server was stopped")
 			return
 
-		default:
-			if configHandler.NeedRestart {
-				time.Sleep(time.Second * 2)
-				fmt.Print("\033[36mServer is now using updated config\n\033[0m")
-				configHandler.NeedRestart = false
-				go StartServer(configHandler, mainContext, cache)
-			}
-			time.Sleep(time.Second)
+		case <-configHandler.Reloads():
+			ReloadServer(configHandler, mainContext, cache)
 		}
 	}
 }
@@ -2,21 +2,27 @@ package utils
 
 import (
 	"context"
-	"fmt"
+	. "godns/logger"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
-func StartShutdownHandler(shutdown context.CancelFunc) {
-	signalChan := make(chan os.Signal)
-	signal.Notify(signalChan, os.Interrupt)
+// StartSignalHandler shuts the server down on an interrupt or SIGTERM and
+// asks for the config to be reloaded on SIGHUP.
+func StartSignalHandler(shutdown context.CancelFunc, reload func()) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	for {
 		sig := <-signalChan
 		switch sig {
-		case os.Interrupt:
-			fmt.Print("\033[32mStarted graceful shutdown...\n\033[0m")
+		case os.Interrupt, syscall.SIGTERM:
+			Infof("Started graceful shutdown...")
 			shutdown()
 			return
+		case syscall.SIGHUP:
+			Infof("Got SIGHUP, reloading config")
+			reload()
 		}
 	}
 }
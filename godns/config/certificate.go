@@ -0,0 +1,57 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	. "godns/logger"
+	"sync"
+)
+
+// CertificateHandler holds the certificate of the encrypted listeners. With
+// watching on, the key pair is loaded again whenever one of its files changes.
+// Handshakes in progress keep the certificate they started with, so
+// established sessions are not affected by a reload.
+type CertificateHandler struct {
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	mu          sync.RWMutex
+}
+
+func NewCertificateHandler(certFile string, keyFile string, watch bool, ctx context.Context) (*CertificateHandler, error) {
+	handler := &CertificateHandler{certFile: certFile, keyFile: keyFile}
+	if err := handler.Reload(); err != nil {
+		return nil, err
+	}
+
+	if watch {
+		for _, path := range []string{certFile, keyFile} {
+			go WatchFile(path, ctx, func() {
+				if err := handler.Reload(); err != nil {
+					Errorf("Can't reload TLS certificate, keeping the old one: %v", err)
+					return
+				}
+				Infof("TLS certificate was reloaded")
+			})
+		}
+	}
+	return handler, nil
+}
+
+func (handler *CertificateHandler) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(handler.certFile, handler.keyFile)
+	if err != nil {
+		return err
+	}
+	handler.mu.Lock()
+	handler.certificate = &certificate
+	handler.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate.
+func (handler *CertificateHandler) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	handler.mu.RLock()
+	defer handler.mu.RUnlock()
+	return handler.certificate, nil
+}
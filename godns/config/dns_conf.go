@@ -2,8 +2,10 @@ package config
 
 import (
 	"context"
-	"fmt"
+	. "godns/logger"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,58 +13,205 @@ import (
 )
 
 type ConfigInstance struct {
-	Nameserver      string        `yaml:"nameserver"`
-	Host            string        `yaml:"host"`
-	UpdateLivetime  bool          `yaml:"update-in-livetime"`
-	CacheExpiration time.Duration `yaml:"cache-expiration"`
-	CacheCleanup    time.Duration `yaml:"cache-cleanup"`
+	Nameserver      string              `yaml:"nameserver"`
+	RootHints       string              `yaml:"root-hints"`
+	Host            string              `yaml:"host"`
+	UpdateLivetime  bool                `yaml:"update-in-livetime"`
+	CacheExpiration time.Duration       `yaml:"cache-expiration"`
+	CacheCleanup    time.Duration       `yaml:"cache-cleanup"`
+	CacheMaxEntries int64               `yaml:"cache-max-entries"`
+	CacheMaxMemory  int64               `yaml:"cache-max-memory"`
+	CacheEviction   string              `yaml:"cache-eviction"`
+	CacheFile       string              `yaml:"cache-file"`
+	CacheSaveEvery  time.Duration       `yaml:"cache-save-interval"`
+	Prefetch        PrefetchConfig      `yaml:"prefetch"`
+	ServeStale      ServeStaleConfig    `yaml:"serve-stale"`
+	TCPIdleTimeout  time.Duration       `yaml:"tcp-idle-timeout"`
+	UDPPayloadSize  uint16              `yaml:"udp-payload-size"`
+	DNSSEC          bool                `yaml:"dnssec"`
+	TrustAnchors    []string            `yaml:"trust-anchors"`
+	DoHPort         int                 `yaml:"doh-port"`
+	DoTPort         int                 `yaml:"dot-port"`
+	DoTIdleTimeout  time.Duration       `yaml:"dot-idle-timeout"`
+	MetricsPort     int                 `yaml:"metrics-port"`
+	LogLevel        string              `yaml:"log-level"`
+	QueryLog        QueryLogConfig      `yaml:"query-log"`
+	Dnstap          DnstapConfig        `yaml:"dnstap"`
+	RateLimit       RateLimitConfig     `yaml:"rate-limit"`
+	ACL             AccessControlConfig `yaml:"acl"`
+	TLSCertFile     string              `yaml:"tls-cert"`
+	TLSKeyFile      string              `yaml:"tls-key"`
+	Zones           []ZoneConfig        `yaml:"zones"`
+	Hosts           map[string]string   `yaml:"hosts"`
+	HostsFiles      []string            `yaml:"hosts-files"`
+	Blocklists      []BlocklistConfig   `yaml:"blocklists"`
+	Mode            string              `yaml:"mode"`
+	Forward         ForwardConfig       `yaml:"forward"`
+
+	ConditionalForward []ConditionalForwardConfig `yaml:"conditional-forward"`
+}
+
+// ForwardConfig describes the upstream resolvers used in forwarding mode.
+type ForwardConfig struct {
+	Strategy  string           `yaml:"strategy"`
+	MaxFails  int              `yaml:"max-fails"`
+	Cooldown  time.Duration    `yaml:"cooldown"`
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+}
+
+// ConditionalForwardConfig sends the names at and below Domain to its own
+// upstreams instead of resolving them as usual.
+type ConditionalForwardConfig struct {
+	Domain        string `yaml:"domain"`
+	ForwardConfig `yaml:",inline"`
+}
+
+// PrefetchConfig says which cache entries are refreshed before they expire:
+// those read at least MinHits times, once less than TTLPercent of their TTL
+// is left. MinHits 0 turns prefetching off.
+type PrefetchConfig struct {
+	MinHits     uint64        `yaml:"min-hits"`
+	TTLPercent  int           `yaml:"ttl-percent"`
+	MinTTL      time.Duration `yaml:"min-ttl"`
+	Concurrency int           `yaml:"concurrency"`
+}
+
+// ServeStaleConfig keeps expired cache entries for MaxStale minutes and
+// answers with them when a name can't be resolved. MaxStale 0 turns it off.
+type ServeStaleConfig struct {
+	MaxStale       time.Duration `yaml:"max-stale"`
+	AnswerTTL      uint32        `yaml:"answer-ttl"`
+	ClientTimeout  time.Duration `yaml:"client-timeout"`
+	RefreshBackoff time.Duration `yaml:"refresh-backoff"`
+}
+
+// QueryLogConfig is where the log of client queries is written and when the
+// file is rotated.
+type QueryLogConfig struct {
+	File        string        `yaml:"file"`
+	MaxSize     int64         `yaml:"max-size"`
+	RotateEvery time.Duration `yaml:"rotate-every"`
+	MaxBackups  int           `yaml:"max-backups"`
 }
 
+// DnstapConfig is where the dnstap frames are written, at most one of a Unix
+// socket, a TCP endpoint and a file, and which message types they carry.
+type DnstapConfig struct {
+	Socket   string   `yaml:"socket"`
+	TCP      string   `yaml:"tcp"`
+	File     string   `yaml:"file"`
+	Identity string   `yaml:"identity"`
+	Messages []string `yaml:"messages"`
+}
+
+// RateLimitConfig limits the queries of each client network and the identical
+// responses sent to it. Zero rates turn the limits off.
+type RateLimitConfig struct {
+	QueriesPerSecond   int      `yaml:"queries-per-second"`
+	QueryBurst         int      `yaml:"query-burst"`
+	ResponsesPerSecond int      `yaml:"responses-per-second"`
+	IPv4Prefix         int      `yaml:"ipv4-prefix"`
+	IPv6Prefix         int      `yaml:"ipv6-prefix"`
+	Slip               int      `yaml:"slip"`
+	Exempt             []string `yaml:"exempt"`
+}
+
+// AccessControlConfig lists the networks, in CIDR notation, that may query
+// the server and those that may have names resolved. Deny lists override the
+// allow lists, and empty allow lists allow everyone.
+type AccessControlConfig struct {
+	AllowQuery     []string `yaml:"allow-query"`
+	DenyQuery      []string `yaml:"deny-query"`
+	AllowRecursion []string `yaml:"allow-recursion"`
+	DenyRecursion  []string `yaml:"deny-recursion"`
+	LocalData      bool     `yaml:"local-data"`
+}
+
+// ZoneConfig names a zone served authoritatively and its master file.
+type ZoneConfig struct {
+	Name string `yaml:"name"`
+	File string `yaml:"file"`
+}
+
+// BlocklistConfig is a list of names to block, or to allow when its action is
+// passthru. Source is a file path or an http(s) or file URL.
+type BlocklistConfig struct {
+	Name     string        `yaml:"name"`
+	Source   string        `yaml:"source"`
+	Format   string        `yaml:"format"`
+	Action   string        `yaml:"action"`
+	Sinkhole []string      `yaml:"sinkhole"`
+	Refresh  time.Duration `yaml:"refresh"`
+}
+
+type UpstreamConfig struct {
+	Address     string   `yaml:"address"`
+	Protocol    string   `yaml:"protocol"`
+	ServerName  string   `yaml:"server-name"`
+	CAFile      string   `yaml:"ca-file"`
+	SPKIPins    []string `yaml:"spki-pins"`
+	Connections int      `yaml:"connections"`
+}
+
+// ConfigHandler holds the config in service. A changed config is read with
+// Read and swapped in with Set once the server is ready for it, so readers
+// always get a complete config, either the old or the new one.
 type ConfigHandler struct {
-	configPath  string
-	configInst  *ConfigInstance
-	mu          sync.RWMutex
-	NeedRestart bool
+	configPath string
+	configInst *ConfigInstance
+	mu         sync.RWMutex
+	reloads    chan struct{}
 }
 
 func NewConfigHandler(path string, ctx context.Context) *ConfigHandler {
-	handler := &ConfigHandler{configPath: path, NeedRestart: false}
+	handler := &ConfigHandler{configPath: path, reloads: make(chan struct{}, 1)}
 	err := handler.Load(ctx)
 	if err != nil {
-		fmt.Print("\033[31mCan't create config loader due to internal error\033[0m")
+		Errorf("Can't create config loader due to internal error: %v", err)
 		os.Exit(0)
 	}
 	return handler
 }
 
 func (handler *ConfigHandler) Load(ctx context.Context) error {
-	config, err := loadConfigFile(handler, ctx)
+	config, err := handler.Read()
 	if err != nil {
 		return err
 	}
-	handler.mu.Lock()
-	handler.configInst = config
-	handler.mu.Unlock()
+	handler.Set(config)
 
 	if config.UpdateLivetime {
-		go watchFile(handler, ctx)
+		go WatchFile(handler.configPath, ctx, func() {
+			Infof("Config file was changed")
+			handler.RequestReload()
+		})
 	}
 	return nil
 }
 
-func (handler *ConfigHandler) Reload(ctx context.Context) error {
-
-	newConfig, err := loadConfigFile(handler, ctx)
-	if err != nil {
-		return err
+// RequestReload asks for the config file to be read again. Requests made
+// while one is still pending are merged into it.
+func (handler *ConfigHandler) RequestReload() {
+	select {
+	case handler.reloads <- struct{}{}:
+	default:
 	}
+}
 
+// Reloads delivers the reload requests.
+func (handler *ConfigHandler) Reloads() <-chan struct{} {
+	return handler.reloads
+}
+
+// Read parses the config file without putting it in service.
+func (handler *ConfigHandler) Read() (*ConfigInstance, error) {
+	return loadConfigFile(handler)
+}
+
+func (handler *ConfigHandler) Set(config *ConfigInstance) {
 	handler.mu.Lock()
-	handler.configInst = newConfig
-	handler.NeedRestart = true
+	handler.configInst = config
 	handler.mu.Unlock()
-
-	return nil
 }
 
 func (handler *ConfigHandler) Get() *ConfigInstance {
@@ -71,7 +220,7 @@ func (handler *ConfigHandler) Get() *ConfigInstance {
 	return handler.configInst
 }
 
-func loadConfigFile(handler *ConfigHandler, ctx context.Context) (*ConfigInstance, error) {
+func loadConfigFile(handler *ConfigHandler) (*ConfigInstance, error) {
 	data, err := os.ReadFile(handler.configPath)
 	config := ConfigInstance{}
 
@@ -83,5 +232,30 @@ func loadConfigFile(handler *ConfigHandler, ctx context.Context) (*ConfigInstanc
 	if err != nil {
 		return nil, err
 	}
+	config.RootHints = getConfigRelativePath(handler, config.RootHints)
+	config.CacheFile = getConfigRelativePath(handler, config.CacheFile)
+	config.QueryLog.File = getConfigRelativePath(handler, config.QueryLog.File)
+	config.Dnstap.Socket = getConfigRelativePath(handler, config.Dnstap.Socket)
+	config.Dnstap.File = getConfigRelativePath(handler, config.Dnstap.File)
+	for i := range config.Zones {
+		config.Zones[i].File = getConfigRelativePath(handler, config.Zones[i].File)
+	}
+	for i := range config.HostsFiles {
+		config.HostsFiles[i] = getConfigRelativePath(handler, config.HostsFiles[i])
+	}
+	for i := range config.Blocklists {
+		if !strings.Contains(config.Blocklists[i].Source, "://") {
+			config.Blocklists[i].Source = getConfigRelativePath(handler, config.Blocklists[i].Source)
+		}
+	}
 	return &config, nil
 }
+
+// getConfigRelativePath resolves paths given in the config file relative to
+// the directory of that file.
+func getConfigRelativePath(handler *ConfigHandler, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(handler.configPath), path)
+}
@@ -2,13 +2,14 @@ package config
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"time"
 )
 
-func watchFile(configLoader *ConfigHandler, ctx context.Context) error {
-	initialStat, err := os.Stat(configLoader.configPath)
+// pollFile polls the file at path and calls onChange whenever its size or
+// modification time changes.
+func pollFile(path string, ctx context.Context, onChange func()) error {
+	initialStat, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
@@ -17,14 +18,13 @@ func watchFile(configLoader *ConfigHandler, ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		default:
-			stat, err := os.Stat(configLoader.configPath)
+			stat, err := os.Stat(path)
 			if err != nil {
 				return err
 			}
 			if stat.Size() != initialStat.Size() || stat.ModTime() != initialStat.ModTime() {
-				fmt.Print("\033[36mConfig file was changed\n\033[0m")
 				initialStat = stat
-				configLoader.Reload(ctx)
+				onChange()
 			}
 			time.Sleep(time.Second / 2)
 		}
@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchedEvents = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+
+// WatchFile calls onChange whenever the file at path is written or replaced,
+// as inotify reports it. The directory of the file is watched rather than the
+// file itself, so editors that save by renaming a new file over the old one
+// are noticed as well. Without inotify, the file is polled.
+func WatchFile(path string, ctx context.Context, onChange func()) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return pollFile(path, ctx, onChange)
+	}
+	dir, name := filepath.Split(filepath.Clean(path))
+	if dir == "" {
+		dir = "."
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, watchedEvents); err != nil {
+		syscall.Close(fd)
+		return pollFile(path, ctx, onChange)
+	}
+
+	// A non-blocking descriptor is read through the runtime poller, so
+	// closing the file ends a pending read.
+	events := os.NewFile(uintptr(fd), "inotify")
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		events.Close()
+	}()
+
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := events.Read(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if hasEventFor(buffer[:n], name) {
+			onChange()
+		}
+	}
+}
+
+// hasEventFor tells whether the inotify events in data concern the file
+// called name, or may have, when the event queue overflowed.
+func hasEventFor(data []byte, name string) bool {
+	found := false
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(data); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&data[offset]))
+		offset += syscall.SizeofInotifyEvent
+		end := offset + int(event.Len)
+		if end > len(data) {
+			break
+		}
+		if event.Mask&syscall.IN_Q_OVERFLOW != 0 || strings.TrimRight(string(data[offset:end]), "\x00") == name {
+			found = true
+		}
+		offset = end
+	}
+	return found
+}
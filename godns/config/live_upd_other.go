@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package config
+
+import "context"
+
+// WatchFile calls onChange whenever the file at path changes.
+func WatchFile(path string, ctx context.Context, onChange func()) error {
+	return pollFile(path, ctx, onChange)
+}
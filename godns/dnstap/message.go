@@ -0,0 +1,165 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// MessageType is the kind of DNS message a frame carries, as numbered in
+// dnstap.proto.
+type MessageType int
+
+const (
+	ResolverQuery    MessageType = 3
+	ResolverResponse MessageType = 4
+	ClientQuery      MessageType = 5
+	ClientResponse   MessageType = 6
+)
+
+var messageTypeNames = map[string]MessageType{
+	"resolver-query":    ResolverQuery,
+	"resolver-response": ResolverResponse,
+	"client-query":      ClientQuery,
+	"client-response":   ClientResponse,
+}
+
+// ParseMessageType returns the message type with the given config name, false
+// for unknown names.
+func ParseMessageType(name string) (MessageType, bool) {
+	messageType, found := messageTypeNames[name]
+	return messageType, found
+}
+
+// SocketProtocol is the transport a DNS message travelled over.
+type SocketProtocol int
+
+const (
+	ProtocolUDP SocketProtocol = 1
+	ProtocolTCP SocketProtocol = 2
+	ProtocolDoT SocketProtocol = 3
+	ProtocolDoH SocketProtocol = 4
+)
+
+const (
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+
+	dnstapTypeMessage = 1
+)
+
+// Message is a DNS message seen by the server along with where it came from
+// and went to. The query side is the client or, for resolver messages, this
+// server; the response side is this server or the upstream it asked.
+type Message struct {
+	Type            MessageType
+	Protocol        SocketProtocol
+	QueryAddress    net.IP
+	QueryPort       int
+	ResponseAddress net.IP
+	ResponsePort    int
+	QueryTime       time.Time
+	ResponseTime    time.Time
+	QueryMessage    []byte
+	ResponseMessage []byte
+}
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// marshal encodes the message as a Dnstap protobuf.
+func (m *Message) marshal(identity, version []byte) []byte {
+	var msg []byte
+	msg = appendVarintField(msg, 1, uint64(m.Type))
+	if family, ok := getSocketFamily(m.QueryAddress, m.ResponseAddress); ok {
+		msg = appendVarintField(msg, 2, family)
+	}
+	if m.Protocol != 0 {
+		msg = appendVarintField(msg, 3, uint64(m.Protocol))
+	}
+	if m.QueryAddress != nil {
+		msg = appendBytesField(msg, 4, getAddressBytes(m.QueryAddress))
+	}
+	if m.ResponseAddress != nil {
+		msg = appendBytesField(msg, 5, getAddressBytes(m.ResponseAddress))
+	}
+	if m.QueryAddress != nil {
+		msg = appendVarintField(msg, 6, uint64(m.QueryPort))
+	}
+	if m.ResponseAddress != nil {
+		msg = appendVarintField(msg, 7, uint64(m.ResponsePort))
+	}
+	if !m.QueryTime.IsZero() {
+		msg = appendVarintField(msg, 8, uint64(m.QueryTime.Unix()))
+		msg = appendFixed32Field(msg, 9, uint32(m.QueryTime.Nanosecond()))
+	}
+	if m.QueryMessage != nil {
+		msg = appendBytesField(msg, 10, m.QueryMessage)
+	}
+	if !m.ResponseTime.IsZero() {
+		msg = appendVarintField(msg, 12, uint64(m.ResponseTime.Unix()))
+		msg = appendFixed32Field(msg, 13, uint32(m.ResponseTime.Nanosecond()))
+	}
+	if m.ResponseMessage != nil {
+		msg = appendBytesField(msg, 14, m.ResponseMessage)
+	}
+
+	var frame []byte
+	if identity != nil {
+		frame = appendBytesField(frame, 1, identity)
+	}
+	if version != nil {
+		frame = appendBytesField(frame, 2, version)
+	}
+	frame = appendBytesField(frame, 14, msg)
+	frame = appendVarintField(frame, 15, dnstapTypeMessage)
+	return frame
+}
+
+func getSocketFamily(addresses ...net.IP) (uint64, bool) {
+	for _, address := range addresses {
+		if address == nil {
+			continue
+		}
+		if address.To4() != nil {
+			return socketFamilyINET, true
+		}
+		return socketFamilyINET6, true
+	}
+	return 0, false
+}
+
+func getAddressBytes(address net.IP) []byte {
+	if ip4 := address.To4(); ip4 != nil {
+		return ip4
+	}
+	return address.To16()
+}
+
+func appendVarintField(data []byte, field int, value uint64) []byte {
+	data = appendVarint(data, uint64(field)<<3|wireVarint)
+	return appendVarint(data, value)
+}
+
+func appendBytesField(data []byte, field int, value []byte) []byte {
+	data = appendVarint(data, uint64(field)<<3|wireBytes)
+	data = appendVarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func appendFixed32Field(data []byte, field int, value uint32) []byte {
+	data = appendVarint(data, uint64(field)<<3|wireFixed32)
+	var fixed [4]byte
+	binary.LittleEndian.PutUint32(fixed[:], value)
+	return append(data, fixed[:]...)
+}
+
+func appendVarint(data []byte, value uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], value)
+	return append(data, varint[:n]...)
+}
@@ -0,0 +1,301 @@
+package dnstap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	. "godns/logger"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Frame Streams control frames, see
+// https://farsightsec.github.io/fstrm/architecture.html
+const (
+	contentType = "protobuf:dnstap.Dnstap"
+
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	controlFieldContentType = 0x01
+	maxControlFrameSize     = 512
+)
+
+const (
+	queueSize        = 10000
+	reconnectDelay   = time.Second * 5
+	handshakeTimeout = time.Second * 5
+)
+
+// Output writes dnstap frames in the Frame Streams format to a Unix socket or
+// TCP endpoint, which gets the bidirectional handshake, or to a file. Frames
+// are queued and written in the background, so a slow or missing collector
+// never holds up the server; frames that don't fit in the queue, or are sent
+// while the collector is unreachable, are dropped.
+type Output struct {
+	network  string
+	address  string
+	identity []byte
+	version  []byte
+
+	ctx   context.Context
+	queue chan []byte
+	done  chan struct{}
+	ended chan struct{}
+}
+
+// NewOutput starts writing to address, where network is "unix", "tcp" or
+// "file". Frames carry identity and version to tell the servers apart. The
+// stream is ended when ctx is done or the output is closed.
+func NewOutput(ctx context.Context, network, address, identity, version string) (*Output, error) {
+	switch network {
+	case "unix", "tcp", "file":
+	default:
+		return nil, fmt.Errorf("unknown dnstap output %s", network)
+	}
+	output := &Output{
+		network:  network,
+		address:  address,
+		identity: []byte(identity),
+		version:  []byte(version),
+		ctx:      ctx,
+		queue:    make(chan []byte, queueSize),
+		done:     make(chan struct{}),
+		ended:    make(chan struct{}),
+	}
+	go output.run()
+	return output, nil
+}
+
+// String describes where the frames go.
+func (output *Output) String() string {
+	return output.network + ":" + output.address
+}
+
+// Send queues the message to be written.
+func (output *Output) Send(m *Message) {
+	select {
+	case output.queue <- m.marshal(output.identity, output.version):
+	default:
+	}
+}
+
+// Close writes the frames still queued, ends the stream and waits for that.
+func (output *Output) Close() {
+	close(output.done)
+	<-output.ended
+}
+
+func (output *Output) run() {
+	defer close(output.ended)
+	warned := false
+	for {
+		stream, err := output.open()
+		if err != nil {
+			if !warned {
+				Warnf("Can't open dnstap output %s, retrying: %v", output, err)
+				warned = true
+			}
+			output.discard()
+			select {
+			case <-output.done:
+				return
+			case <-output.ctx.Done():
+				return
+			case <-time.After(reconnectDelay):
+				continue
+			}
+		}
+
+		warned = false
+		err = output.write(stream)
+		stream.close()
+		if err == nil {
+			return
+		}
+		Warnf("Dnstap output %s failed: %v", output, err)
+	}
+}
+
+// discard drops the frames queued so far.
+func (output *Output) discard() {
+	for {
+		select {
+		case <-output.queue:
+		default:
+			return
+		}
+	}
+}
+
+// write copies the queued frames to the stream until the output is closed or
+// its context is done, which returns nil, or the stream fails.
+func (output *Output) write(stream *frameStream) error {
+	for {
+		select {
+		case frame := <-output.queue:
+			if err := stream.writeData(frame); err != nil {
+				return err
+			}
+			if len(output.queue) == 0 {
+				if err := stream.flush(); err != nil {
+					return err
+				}
+			}
+		case <-output.ctx.Done():
+			stream.finish()
+			return nil
+		case <-output.done:
+			for len(output.queue) > 0 {
+				if err := stream.writeData(<-output.queue); err != nil {
+					return err
+				}
+			}
+			stream.finish()
+			return nil
+		}
+	}
+}
+
+// frameStream is an open Frame Streams connection or file after the
+// handshake, ready for data frames.
+type frameStream struct {
+	conn          io.ReadWriteCloser
+	writer        *bufio.Writer
+	bidirectional bool
+}
+
+func (output *Output) open() (*frameStream, error) {
+	var stream *frameStream
+	if output.network == "file" {
+		file, err := os.OpenFile(output.address, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		stream = &frameStream{conn: file, writer: bufio.NewWriter(file)}
+	} else {
+		conn, err := net.DialTimeout(output.network, output.address, handshakeTimeout)
+		if err != nil {
+			return nil, err
+		}
+		stream = &frameStream{conn: conn, writer: bufio.NewWriter(conn), bidirectional: true}
+		if err := stream.handshake(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if err := stream.writeControl(controlStart); err != nil {
+		stream.close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// handshake offers the content type to the collector and waits until it
+// accepts it.
+func (stream *frameStream) handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := stream.writeControl(controlReady); err != nil {
+		return err
+	}
+	if err := stream.flush(); err != nil {
+		return err
+	}
+	controlType, err := readControl(conn)
+	if err != nil {
+		return err
+	}
+	if controlType != controlAccept {
+		return fmt.Errorf("collector answered READY with control frame %d", controlType)
+	}
+	return nil
+}
+
+// finish ends the stream with a STOP frame and, on a connection, waits for
+// the collector to confirm it.
+func (stream *frameStream) finish() {
+	if err := stream.writeControl(controlStop); err != nil {
+		return
+	}
+	if err := stream.flush(); err != nil {
+		return
+	}
+	if conn, ok := stream.conn.(net.Conn); ok && stream.bidirectional {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		readControl(conn)
+	}
+}
+
+func (stream *frameStream) close() {
+	stream.conn.Close()
+}
+
+func (stream *frameStream) flush() error {
+	return stream.writer.Flush()
+}
+
+// writeData writes one data frame, prefixed by its length.
+func (stream *frameStream) writeData(frame []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	if _, err := stream.writer.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := stream.writer.Write(frame)
+	return err
+}
+
+// writeControl writes a control frame: a zero length escape, the length of
+// the control frame, its type and, except for STOP, the content type.
+func (stream *frameStream) writeControl(controlType uint32) error {
+	var control []byte
+	control = appendUint32(control, controlType)
+	if controlType != controlStop {
+		control = appendUint32(control, controlFieldContentType)
+		control = appendUint32(control, uint32(len(contentType)))
+		control = append(control, contentType...)
+	}
+
+	var frame []byte
+	frame = appendUint32(frame, 0)
+	frame = appendUint32(frame, uint32(len(control)))
+	frame = append(frame, control...)
+	_, err := stream.writer.Write(frame)
+	return err
+}
+
+// readControl reads a control frame from the collector and returns its type.
+func readControl(reader io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return 0, errors.New("collector sent a data frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > maxControlFrameSize {
+		return 0, fmt.Errorf("control frame of %d bytes", length)
+	}
+	control := make([]byte, length)
+	if _, err := io.ReadFull(reader, control); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(control), nil
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	var word [4]byte
+	binary.BigEndian.PutUint32(word[:], value)
+	return append(data, word[:]...)
+}
@@ -0,0 +1,72 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Level orders the operational messages by importance. Messages below the
+// configured level are not printed.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[string]Level{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+// Terminal colours of the levels.
+var levelColours = map[Level]string{
+	LevelDebug: "\033[90m",
+	LevelInfo:  "\033[36m",
+	LevelWarn:  "\033[33m",
+	LevelError: "\033[31m",
+}
+
+var currentLevel = int32(LevelInfo)
+
+// ParseLevel returns the level with the given name, false for unknown names.
+// An empty name is the info level.
+func ParseLevel(name string) (Level, bool) {
+	if name == "" {
+		return LevelInfo, true
+	}
+	level, found := levelNames[strings.ToLower(name)]
+	return level, found
+}
+
+func SetLevel(level Level) {
+	atomic.StoreInt32(&currentLevel, int32(level))
+}
+
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+}
+
+func logf(level Level, format string, args ...interface{}) {
+	if int32(level) < atomic.LoadInt32(&currentLevel) {
+		return
+	}
+	fmt.Print(levelColours[level], fmt.Sprintf(format, args...), "\n\033[0m")
+}
@@ -0,0 +1,130 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405.000"
+
+// RotatingFile is a log file that is moved aside and started again once it
+// grows past maxSize bytes or a new period of rotateEvery begins. Rotated
+// files get the time of the rotation appended to their name, and only the
+// newest maxBackups of them are kept. Zero values disable each limit.
+type RotatingFile struct {
+	mu          sync.Mutex
+	path        string
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+
+	file    *os.File
+	size    int64
+	written time.Time
+}
+
+// OpenRotatingFile opens the log file at path for appending, creating it if
+// needed.
+func OpenRotatingFile(path string, maxSize int64, rotateEvery time.Duration, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:        path,
+		maxSize:     maxSize,
+		rotateEvery: rotateEvery,
+		maxBackups:  maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.written = info.ModTime()
+	return nil
+}
+
+// Write appends p to the file, rotating it first when p does not fit or the
+// last write was in an earlier period.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	now := time.Now()
+	tooBig := rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize
+	tooOld := rf.rotateEvery > 0 && rf.size > 0 && !now.Truncate(rf.rotateEvery).Equal(rf.written.Truncate(rf.rotateEvery))
+	if tooBig || tooOld {
+		if err := rf.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	rf.written = now
+	return n, err
+}
+
+// rotate moves the file aside and opens a new one. If the file can't be
+// moved, writing goes on at its end.
+func (rf *RotatingFile) rotate(now time.Time) error {
+	rf.file.Close()
+	rf.file = nil
+	os.Rename(rf.path, rf.path+"."+now.Format(backupTimeFormat))
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups deletes the rotated files beyond maxBackups. The time in
+// their names sorts them from the oldest to the newest.
+func (rf *RotatingFile) removeOldBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, backup := range backups {
+		stamp := backup[len(rf.path)+1:]
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+	sort.Strings(rotated)
+	for len(rotated) > rf.maxBackups {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
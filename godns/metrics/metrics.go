@@ -0,0 +1,306 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is a metric family that can write itself in the Prometheus text
+// exposition format.
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+// WriteTo writes every registered metric in the Prometheus text format.
+func WriteTo(w io.Writer) error {
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// Handler serves the registered metrics to a Prometheus scraper.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// series holds the label values of one time series of a family.
+type series struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	sum         float64
+	count       uint64
+}
+
+// family is the state shared by the metric types: the series by their label
+// values, joined into one key.
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newFamily(name string, help string, metricType string, labels []string) family {
+	return family{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		series:     make(map[string]*series),
+	}
+}
+
+// get returns the series for the label values, creating it on first use. The
+// caller holds mu.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s needs %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, found := f.series[key]
+	if !found {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series ordered by their label values, so that scrapes
+// list them the same way each time. The caller holds mu.
+func (f *family) sorted() []*series {
+	list := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].labelValues, list[j].labelValues
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return list
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.metricType)
+}
+
+// CounterVec is a counter split by labels.
+type CounterVec struct {
+	family
+}
+
+// NewCounterVec registers a counter with the given label names.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newFamily(name, help, "counter", labels)}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series of the label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds value, which must not be negative, to the series of the label
+// values.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(labelValues).value += value
+}
+
+// Value returns the current value of the series of the label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(labelValues).value
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	for _, s := range c.sorted() {
+		writeSample(w, c.name, c.labels, s.labelValues, "", "", s.value)
+	}
+}
+
+// Gauge is a single value that goes up and down.
+type Gauge struct {
+	family
+}
+
+// NewGauge registers a gauge without labels.
+func NewGauge(name string, help string) *Gauge {
+	g := &Gauge{newFamily(name, help, "gauge", nil)}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Add(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(nil).value += value
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(w)
+	writeSample(w, g.name, nil, nil, "", "", g.get(nil).value)
+}
+
+// funcMetric is a counter or gauge whose value is read from elsewhere when
+// the metrics are scraped.
+type funcMetric struct {
+	family
+	value func() float64
+}
+
+// NewGaugeFunc registers a gauge that calls value on every scrape.
+func NewGaugeFunc(name string, help string, value func() float64) {
+	register(&funcMetric{newFamily(name, help, "gauge", nil), value})
+}
+
+// NewCounterFunc registers a counter that calls value on every scrape.
+func NewCounterFunc(name string, help string, value func() float64) {
+	register(&funcMetric{newFamily(name, help, "counter", nil), value})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	writeSample(w, m.name, nil, nil, "", "", m.value())
+}
+
+// HistogramVec counts observations in cumulative buckets, split by labels.
+type HistogramVec struct {
+	family
+	upperBounds []float64
+}
+
+// NewHistogramVec registers a histogram with the given bucket upper bounds,
+// which must be sorted, and label names.
+func NewHistogramVec(name string, help string, upperBounds []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{newFamily(name, help, "histogram", labels), upperBounds}
+	register(h)
+	return h
+}
+
+// Observe adds value to the series of the label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.upperBounds))
+	}
+	for i, bound := range h.upperBounds {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, s := range h.sorted() {
+		for i, bound := range h.upperBounds {
+			writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", formatValue(bound), float64(s.buckets[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, "", "", s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+// writeSample writes one line of a family, with an extra label like the le of
+// histogram buckets when extraName is set.
+func writeSample(w *bufio.Writer, name string, labels []string, labelValues []string, extraName string, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabelValue(labelValues[i]))
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(value))
+	w.WriteByte('\n')
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	. "godns/config"
+	"net"
+	"strings"
+)
+
+// clientAccess is what a client may ask for.
+type clientAccess int
+
+const (
+	accessDenied clientAccess = iota
+	accessLocal
+	accessFull
+)
+
+// accessList matches client addresses. A match in deny overrides allow, and
+// an empty allow list allows everyone.
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newAccessList(allow []string, deny []string) (accessList, error) {
+	var list accessList
+	var err error
+	if list.allow, err = parseNetworks(allow); err != nil {
+		return list, err
+	}
+	if list.deny, err = parseNetworks(deny); err != nil {
+		return list, err
+	}
+	return list, nil
+}
+
+func (list accessList) permits(ip net.IP) bool {
+	if ip == nil {
+		return len(list.allow) == 0 && len(list.deny) == 0
+	}
+	if containsIP(list.deny, ip) {
+		return false
+	}
+	return len(list.allow) == 0 || containsIP(list.allow, ip)
+}
+
+// accessControl decides which clients may query at all and which of them may
+// have names resolved, from the cache or by recursion. With localData set,
+// clients denied recursion still get the hosts and the local zones.
+type accessControl struct {
+	query     accessList
+	recursion accessList
+	localData bool
+}
+
+func newAccessControl(aclConf AccessControlConfig) (*accessControl, error) {
+	query, err := newAccessList(aclConf.AllowQuery, aclConf.DenyQuery)
+	if err != nil {
+		return nil, err
+	}
+	recursion, err := newAccessList(aclConf.AllowRecursion, aclConf.DenyRecursion)
+	if err != nil {
+		return nil, err
+	}
+	return &accessControl{query: query, recursion: recursion, localData: aclConf.LocalData}, nil
+}
+
+func (acl *accessControl) check(ip net.IP) clientAccess {
+	if !acl.query.permits(ip) {
+		return accessDenied
+	}
+	if acl.recursion.permits(ip) {
+		return accessFull
+	}
+	if acl.localData {
+		return accessLocal
+	}
+	return accessDenied
+}
+
+// parseNetworks reads a list of networks in CIDR notation. A bare address is
+// a network of its own.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+				}
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+				continue
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("bad network %s: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
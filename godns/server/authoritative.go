@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	. "godns/config"
+	. "godns/logger"
+	. "godns/zones"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+)
+
+// localZoneSet holds the zones served authoritatively, by origin.
+type localZoneSet struct {
+	mu        sync.RWMutex
+	zones     map[string]*Zone
+	stopWatch context.CancelFunc
+}
+
+var localZones = &localZoneSet{zones: make(map[string]*Zone), stopWatch: func() {}}
+
+// load reads the zone files of the config. A zone that fails to load is left
+// out. With update-in-livetime on, each zone is loaded again when one of its
+// files changes, and a broken edit keeps the previous version in service.
+func (lz *localZoneSet) load(handler *ConfigHandler, mainContext context.Context) {
+	config := handler.Get()
+	zones := make(map[string]*Zone)
+	for _, zoneConf := range config.Zones {
+		zone, err := Load(zoneConf.File, zoneConf.Name)
+		if err != nil {
+			Errorf("Can't load zone %s: %v", zoneConf.Name, err)
+			continue
+		}
+		zones[zone.Origin] = zone
+	}
+
+	watchContext, stop := context.WithCancel(mainContext)
+	lz.mu.Lock()
+	lz.stopWatch()
+	lz.zones = zones
+	lz.stopWatch = stop
+	lz.mu.Unlock()
+
+	if !config.UpdateLivetime {
+		return
+	}
+	for _, zoneConf := range config.Zones {
+		files := []string{zoneConf.File}
+		if zone := zones[canonicalName(zoneConf.Name)]; zone != nil {
+			files = zone.Files
+		}
+		watch := &zoneWatch{context: watchContext, conf: zoneConf, files: make(map[string]context.CancelFunc)}
+		lz.watch(watch, files)
+	}
+}
+
+// zoneWatch keeps a watch on every file a zone was read from, $INCLUDEd ones
+// too. The set follows the files of the last version that loaded.
+type zoneWatch struct {
+	mu      sync.Mutex
+	context context.Context
+	conf    ZoneConfig
+	files   map[string]context.CancelFunc
+}
+
+// watch starts watching the files not watched yet and stops watching those
+// the zone no longer includes. The zone file itself is always watched.
+func (lz *localZoneSet) watch(watch *zoneWatch, files []string) {
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	current := make(map[string]bool)
+	for _, path := range files {
+		current[path] = true
+		if _, found := watch.files[path]; found {
+			continue
+		}
+		fileContext, stop := context.WithCancel(watch.context)
+		watch.files[path] = stop
+		go WatchFile(path, fileContext, func() { lz.reload(watch) })
+	}
+	for path, stop := range watch.files {
+		if !current[path] && path != watch.conf.File {
+			stop()
+			delete(watch.files, path)
+		}
+	}
+}
+
+// reload loads a zone again after one of its files changed. A broken edit
+// keeps the previous version in service.
+func (lz *localZoneSet) reload(watch *zoneWatch) {
+	zone, err := Load(watch.conf.File, watch.conf.Name)
+	if err != nil {
+		Errorf("Can't reload zone %s, keeping the old one: %v", watch.conf.Name, err)
+		return
+	}
+	lz.mu.Lock()
+	if watch.context.Err() != nil {
+		// The config was reloaded meanwhile and the zone with it.
+		lz.mu.Unlock()
+		return
+	}
+	lz.zones[zone.Origin] = zone
+	lz.mu.Unlock()
+	Infof("Zone %s was reloaded", watch.conf.Name)
+	lz.watch(watch, zone.Files)
+}
+
+// find returns the zone with the longest origin that name belongs to.
+func (lz *localZoneSet) find(name string) *Zone {
+	lz.mu.RLock()
+	defer lz.mu.RUnlock()
+	name = canonicalName(name)
+	for {
+		if zone, found := lz.zones[name]; found {
+			return zone
+		}
+		if name == "" {
+			return nil
+		}
+		name = parentName(name)
+	}
+}
+
+// getLocalResponse answers questions for names in the local zones. The second
+// result is false for names outside of them.
+func getLocalResponse(dnsIntReq layers.DNS) (layers.DNS, bool) {
+	question := dnsIntReq.Questions[0]
+	if question.Class != layers.DNSClassIN {
+		return layers.DNS{}, false
+	}
+	zone := localZones.find(string(question.Name))
+	if zone == nil {
+		return layers.DNS{}, false
+	}
+
+	dnsResponse := getErrorResponse(dnsIntReq, layers.DNSResponseCodeNoErr)
+	dnsResponse.AA = true
+
+	name := canonicalName(string(question.Name))
+	seen := make(map[string]bool)
+	for {
+		if cut := zone.Delegation(name); cut != "" && !(question.Type == dnsTypeDS && cut == name) {
+			// Names below a zone cut belong to the child zone, so only
+			// the referral can be given.
+			if len(dnsResponse.Answers) == 0 {
+				dnsResponse.AA = false
+			}
+			nameservers := getRecordsOfType(zone.Records(cut), layers.DNSTypeNS)
+			dnsResponse.Authorities = nameservers
+			dnsResponse.Additionals = getLocalGlue(zone, nameservers)
+			return dnsResponse, true
+		}
+
+		records, exists := zone.Lookup(name)
+		if !exists {
+			dnsResponse.ResponseCode = layers.DNSResponseCodeNXDomain
+			dnsResponse.Authorities = []layers.DNSResourceRecord{zone.SOA()}
+			return dnsResponse, true
+		}
+
+		if answers := getRecordsOfType(records, question.Type); len(answers) > 0 || (question.Type == dnsTypeANY && len(records) > 0) {
+			if question.Type == dnsTypeANY {
+				answers = records
+			}
+			dnsResponse.Answers = append(dnsResponse.Answers, answers...)
+			if question.Type == layers.DNSTypeNS {
+				dnsResponse.Additionals = getLocalGlue(zone, answers)
+			}
+			return dnsResponse, true
+		}
+
+		aliases := getRecordsOfType(records, layers.DNSTypeCNAME)
+		if len(aliases) == 0 || question.Type == layers.DNSTypeCNAME {
+			dnsResponse.Authorities = []layers.DNSResourceRecord{zone.SOA()}
+			return dnsResponse, true
+		}
+
+		dnsResponse.Answers = append(dnsResponse.Answers, aliases[0])
+		seen[name] = true
+		name = canonicalName(string(aliases[0].CNAME))
+		if seen[name] {
+			return getErrorResponse(dnsIntReq, layers.DNSResponseCodeServFail), true
+		}
+		if !zone.Contains(name) || zone.Delegation(name) != "" {
+			// The rest of the chain is resolved like any other name.
+			return dnsResponse, true
+		}
+	}
+}
+
+// getLocalGlue returns the addresses the zone has for the nameservers.
+func getLocalGlue(zone *Zone, nameservers []layers.DNSResourceRecord) []layers.DNSResourceRecord {
+	var glue []layers.DNSResourceRecord
+	for _, ns := range nameservers {
+		for _, rr := range zone.Records(string(ns.NS)) {
+			if rr.Type == layers.DNSTypeA || rr.Type == layers.DNSTypeAAAA {
+				glue = append(glue, rr)
+			}
+		}
+	}
+	return glue
+}
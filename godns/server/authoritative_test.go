@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	. "godns/config"
+	. "godns/zones"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForZoneAddress rewrites path until the zone set answers name with ip.
+// Each write is repeated because the watches start in the background.
+func waitForZoneAddress(t *testing.T, lz *localZoneSet, path string, data string, name string, ip string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if zone := lz.find(name); zone != nil {
+			for _, rr := range zone.Records(name) {
+				if rr.IP.String() == ip {
+					return
+				}
+			}
+		}
+	}
+	t.Fatalf("%s was not reloaded with %s", name, ip)
+}
+
+func TestZoneReloadsWhenAnIncludedFileChanges(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"conf.yaml": "update-in-livetime: true\nzones:\n  - name: example.test\n    file: zone\n",
+		"zone":      "$TTL 300\n@ SOA ns hostmaster 1 2 3 4 5\n$INCLUDE hosts\n",
+		"hosts":     "www A 192.0.2.1\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler := NewConfigHandler(filepath.Join(dir, "conf.yaml"), ctx)
+	lz := &localZoneSet{zones: make(map[string]*Zone), stopWatch: func() {}}
+	lz.load(handler, ctx)
+	if zone := lz.find("www.example.test"); zone == nil || len(zone.Records("www.example.test")) != 1 {
+		t.Fatal("the included record was not loaded")
+	}
+
+	// A change to the included file reloads the zone, and a file that the
+	// new version includes is watched from then on.
+	if err := os.WriteFile(filepath.Join(dir, "more"), []byte("mail A 192.0.2.3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitForZoneAddress(t, lz, filepath.Join(dir, "hosts"),
+		"www A 192.0.2.2\n$INCLUDE more\n", "www.example.test", "192.0.2.2")
+	waitForZoneAddress(t, lz, filepath.Join(dir, "more"),
+		"mail A 192.0.2.4\n", "mail.example.test", "192.0.2.4")
+}
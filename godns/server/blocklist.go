@@ -0,0 +1,482 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	. "godns/zones"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// blockTTL is the TTL given to answers made up for blocked names.
+	blockTTL = 60
+
+	blocklistFetchTimeout = time.Second * 30
+)
+
+type blockAction int
+
+const (
+	blockNXDomain blockAction = iota
+	blockNoData
+	blockSinkhole
+	blockPassthru
+	blockDrop
+	blockRewrite
+)
+
+var blockActions = map[string]blockAction{
+	"nxdomain": blockNXDomain,
+	"nodata":   blockNoData,
+	"sinkhole": blockSinkhole,
+	"passthru": blockPassthru,
+}
+
+// hostsFileNames are the entries that block lists in the hosts format carry
+// for the machine itself and that must not be blocked.
+var hostsFileNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// blockRule is what is done with a matching name. addresses are the sinkhole
+// or RPZ local data addresses and target is the name of an RPZ CNAME rewrite.
+type blockRule struct {
+	action    blockAction
+	addresses []net.IP
+	target    string
+}
+
+// blocklist is one list of the config. Rules for *.name are kept under name in
+// wildcard and match every name below it, but not name itself.
+type blocklist struct {
+	config   BlocklistConfig
+	mu       sync.RWMutex
+	exact    map[string]blockRule
+	wildcard map[string]blockRule
+}
+
+// blocklistSet holds the lists in the order of the config.
+type blocklistSet struct {
+	mu          sync.RWMutex
+	lists       []*blocklist
+	stopRefresh context.CancelFunc
+}
+
+var blocklists = &blocklistSet{stopRefresh: func() {}}
+
+// load reads every list of the config and refreshes each one in the background
+// at its own interval. A list that fails to load stays empty until a refresh
+// succeeds, and a failed refresh keeps the previous rules.
+func (bs *blocklistSet) load(handler *ConfigHandler, mainContext context.Context) {
+	config := handler.Get()
+	var lists []*blocklist
+	for _, listConf := range config.Blocklists {
+		list := &blocklist{config: listConf}
+		if err := list.refresh(); err != nil {
+			Errorf("Can't load blocklist %s: %v", listConf.Name, err)
+		}
+		lists = append(lists, list)
+	}
+
+	refreshContext, stop := context.WithCancel(mainContext)
+	bs.mu.Lock()
+	bs.stopRefresh()
+	bs.lists = lists
+	bs.stopRefresh = stop
+	bs.mu.Unlock()
+
+	for _, list := range lists {
+		if list.config.Refresh > 0 {
+			go list.refreshEvery(refreshContext, time.Second*list.config.Refresh)
+		}
+	}
+}
+
+func (list *blocklist) refreshEvery(refreshContext context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-refreshContext.Done():
+			return
+		case <-ticker.C:
+			if err := list.refresh(); err != nil {
+				Errorf("Can't refresh blocklist %s, keeping the old one: %v", list.config.Name, err)
+				continue
+			}
+			Debugf("Blocklist %s was refreshed, %d rules, %.0f hits", list.config.Name, list.size(), blocklistHits.Value(list.config.Name))
+		}
+	}
+}
+
+// refresh reads the source of the list again and replaces its rules.
+func (list *blocklist) refresh() error {
+	data, err := readBlocklistSource(list.config.Source)
+	if err != nil {
+		return err
+	}
+
+	action, found := blockActions[strings.ToLower(list.config.Action)]
+	if !found && list.config.Action != "" {
+		return errors.New("unknown blocklist action " + list.config.Action)
+	}
+	var sinkhole []net.IP
+	for _, address := range list.config.Sinkhole {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return errors.New("invalid sinkhole address " + address)
+		}
+		sinkhole = append(sinkhole, ip)
+	}
+
+	rules := &blocklist{exact: make(map[string]blockRule), wildcard: make(map[string]blockRule)}
+	switch strings.ToLower(list.config.Format) {
+	case "hosts":
+		err = rules.parseHosts(data, action, sinkhole)
+	case "domains", "":
+		err = rules.parseDomains(data, action, sinkhole)
+	case "rpz":
+		err = rules.parseRPZ(data, list.config, action, sinkhole)
+	default:
+		err = errors.New("unknown blocklist format " + list.config.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	list.mu.Lock()
+	list.exact = rules.exact
+	list.wildcard = rules.wildcard
+	list.mu.Unlock()
+	return nil
+}
+
+// readBlocklistSource returns the content of a file or of an http(s) or file
+// URL.
+func readBlocklistSource(source string) ([]byte, error) {
+	if path, isLocal := getLocalBlocklistPath(source); isLocal {
+		return os.ReadFile(path)
+	}
+	sourceURL, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	switch sourceURL.Scheme {
+	case "http", "https":
+		client := http.Client{Timeout: blocklistFetchTimeout}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(source + ": " + resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	return nil, errors.New("unsupported blocklist URL " + source)
+}
+
+// getLocalBlocklistPath returns the file path of a source given as a path or
+// a file:// URL. The second result is false for every other source.
+func getLocalBlocklistPath(source string) (string, bool) {
+	if !strings.Contains(source, "://") {
+		return source, true
+	}
+	sourceURL, err := url.Parse(source)
+	if err != nil || sourceURL.Scheme != "file" {
+		return "", false
+	}
+	return sourceURL.Path, true
+}
+
+// parseHosts reads a list in the /etc/hosts format. Without sinkhole
+// addresses in the config, the addresses of the file are given for sinkholed
+// names.
+func (list *blocklist) parseHosts(data []byte, action blockAction, sinkhole []net.IP) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(stripComment(scanner.Text()))
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		addresses := sinkhole
+		if addresses == nil {
+			addresses = []net.IP{ip}
+		}
+		for _, name := range fields[1:] {
+			name = canonicalName(name)
+			if hostsFileNames[name] || net.ParseIP(name) != nil {
+				continue
+			}
+			list.add(name, blockRule{action: action, addresses: addresses})
+		}
+	}
+	return scanner.Err()
+}
+
+// parseDomains reads a list with one name per line.
+func (list *blocklist) parseDomains(data []byte, action blockAction, sinkhole []net.IP) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(stripComment(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		list.add(canonicalName(fields[0]), blockRule{action: action, addresses: sinkhole})
+	}
+	return scanner.Err()
+}
+
+// parseRPZ reads a response policy zone and keeps its QNAME triggers. The
+// action of each rule comes from its records: CNAME . is NXDOMAIN, CNAME *.
+// is NODATA, CNAME rpz-passthru. and rpz-drop. pass and drop the query, a
+// CNAME to another name rewrites the answer and A and AAAA records are given
+// as they are. An action set in the config replaces the one of every rule.
+// $INCLUDE is only followed in zones read from a local file.
+func (list *blocklist) parseRPZ(data []byte, listConf BlocklistConfig, action blockAction, sinkhole []net.IP) error {
+	source, isLocal := getLocalBlocklistPath(listConf.Source)
+	if !isLocal {
+		source = listConf.Source
+	}
+	records, err := Parse(data, source, listConf.Name, isLocal)
+	if err != nil {
+		return err
+	}
+	origin := canonicalName(listConf.Name)
+	for _, rr := range records {
+		owner := canonicalName(string(rr.Name))
+		if owner == origin || !isSubdomain(owner, origin) {
+			continue
+		}
+		name := strings.TrimSuffix(owner, "."+origin)
+		if isRPZTrigger(name) {
+			// IP, client and nameserver triggers are not supported.
+			continue
+		}
+
+		var rule blockRule
+		switch rr.Type {
+		case layers.DNSTypeCNAME:
+			switch target := canonicalName(string(rr.CNAME)); target {
+			case "":
+				rule.action = blockNXDomain
+			case "*":
+				rule.action = blockNoData
+			case "rpz-passthru":
+				rule.action = blockPassthru
+			case "rpz-drop":
+				rule.action = blockDrop
+			case "rpz-tcp-only":
+				continue
+			default:
+				rule.action = blockRewrite
+				rule.target = target
+			}
+		case layers.DNSTypeA, layers.DNSTypeAAAA:
+			rule.action = blockSinkhole
+			rule.addresses = []net.IP{rr.IP}
+			if existing, found := list.lookup(name); found && existing.action == blockSinkhole {
+				rule.addresses = append(existing.addresses, rr.IP)
+			}
+		default:
+			continue
+		}
+
+		if listConf.Action != "" {
+			rule = blockRule{action: action, addresses: sinkhole}
+		}
+		list.add(name, rule)
+	}
+	return nil
+}
+
+func isRPZTrigger(name string) bool {
+	labels := nameLabels(name)
+	for _, label := range labels {
+		switch label {
+		case "rpz-ip", "rpz-client-ip", "rpz-nsip", "rpz-nsdname":
+			return true
+		}
+	}
+	return false
+}
+
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+func (list *blocklist) add(name string, rule blockRule) {
+	if strings.HasPrefix(name, "*.") {
+		list.wildcard[strings.TrimPrefix(name, "*.")] = rule
+	} else if name != "" {
+		list.exact[name] = rule
+	}
+}
+
+func (list *blocklist) lookup(name string) (blockRule, bool) {
+	if strings.HasPrefix(name, "*.") {
+		rule, found := list.wildcard[strings.TrimPrefix(name, "*.")]
+		return rule, found
+	}
+	rule, found := list.exact[name]
+	return rule, found
+}
+
+func (list *blocklist) size() int {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	return len(list.exact) + len(list.wildcard)
+}
+
+// match returns the rule for name, preferring the exact name and then the
+// wildcard of the closest parent.
+func (list *blocklist) match(name string) (blockRule, bool) {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	if rule, found := list.exact[name]; found {
+		return rule, true
+	}
+	for parent := parentName(name); ; parent = parentName(parent) {
+		if rule, found := list.wildcard[parent]; found {
+			return rule, true
+		}
+		if parent == "" {
+			return blockRule{}, false
+		}
+	}
+}
+
+// match returns the rule to apply to name. A passthru rule in any list wins,
+// otherwise the first list that matches decides. The hit is counted on the
+// list whose rule is applied.
+func (bs *blocklistSet) match(name string) (blockRule, bool) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	name = canonicalName(name)
+
+	var blockedBy *blocklist
+	var blockedRule blockRule
+	for _, list := range bs.lists {
+		rule, found := list.match(name)
+		if !found {
+			continue
+		}
+		if rule.action == blockPassthru {
+			blocklistHits.Inc(list.config.Name)
+			return blockRule{}, false
+		}
+		if blockedBy == nil {
+			blockedBy, blockedRule = list, rule
+		}
+	}
+	if blockedBy == nil {
+		return blockRule{}, false
+	}
+	blocklistHits.Inc(blockedBy.config.Name)
+	return blockedRule, true
+}
+
+// getBlockedResponse answers a question for a blocked name. The second result
+// is false when the query is dropped.
+func getBlockedResponse(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, rule blockRule, cache *Cache, trace *queryTrace) (layers.DNS, bool) {
+	question := dnsIntReq.Questions[0]
+	switch rule.action {
+	case blockDrop:
+		return layers.DNS{}, false
+	case blockNXDomain:
+		dnsResponse := getErrorResponse(dnsIntReq, layers.DNSResponseCodeNXDomain)
+		dnsResponse.Authorities = []layers.DNSResourceRecord{getBlockedSOA(question.Name)}
+		return dnsResponse, true
+	}
+
+	dnsResponse := getErrorResponse(dnsIntReq, layers.DNSResponseCodeNoErr)
+	switch rule.action {
+	case blockSinkhole:
+		addresses := rule.addresses
+		if addresses == nil {
+			addresses = []net.IP{net.IPv4zero, net.IPv6zero}
+		}
+		for _, ip := range addresses {
+			rrType := layers.DNSTypeAAAA
+			if ip.To4() != nil {
+				rrType = layers.DNSTypeA
+				ip = ip.To4()
+			}
+			if rrType == question.Type {
+				dnsResponse.Answers = append(dnsResponse.Answers, layers.DNSResourceRecord{
+					Name:  question.Name,
+					Type:  rrType,
+					Class: layers.DNSClassIN,
+					TTL:   blockTTL,
+					IP:    ip,
+				})
+			}
+		}
+
+	case blockRewrite:
+		dnsResponse.Answers = []layers.DNSResourceRecord{{
+			Name:  question.Name,
+			Type:  layers.DNSTypeCNAME,
+			Class: layers.DNSClassIN,
+			TTL:   blockTTL,
+			CNAME: []byte(rule.target),
+		}}
+		return chaseCNAMEs(handler, state, dnsIntReq, dnsResponse, cache, trace)
+	}
+	if len(dnsResponse.Answers) == 0 {
+		dnsResponse.Authorities = []layers.DNSResourceRecord{getBlockedSOA(question.Name)}
+	}
+	return dnsResponse, true
+}
+
+// getBlockedSOA makes up an SOA record for a blocked name, so that clients
+// can cache the NXDOMAIN or NODATA answer for blockTTL seconds (RFC 2308).
+func getBlockedSOA(name []byte) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{
+		Name:  name,
+		Type:  layers.DNSTypeSOA,
+		Class: layers.DNSClassIN,
+		TTL:   blockTTL,
+		SOA: layers.DNSSOA{
+			MName:   []byte("localhost"),
+			RName:   []byte("nobody.localhost"),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minimum: blockTTL,
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	"os"
+	"time"
+)
+
+var stopCacheSnapshots context.CancelFunc = func() {}
+
+// loadCacheFile warms the cache up with the snapshot written when the server
+// last stopped. A missing snapshot is not an error, the cache starts empty.
+func loadCacheFile(config *ConfigInstance, cache *Cache) {
+	if config.CacheFile == "" {
+		return
+	}
+	loaded, err := cache.Load(config.CacheFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			Debugf("No cache snapshot at %s yet", config.CacheFile)
+		} else {
+			Warnf("Can't load cache snapshot %s: %v", config.CacheFile, err)
+		}
+		return
+	}
+	Infof("Loaded %d cache entries from %s", loaded, config.CacheFile)
+}
+
+// SaveCache writes the cache to the cache-file of the config, if there is one.
+// It is called on shutdown.
+func SaveCache(handler *ConfigHandler, cache *Cache) {
+	config := handler.Get()
+	if config.CacheFile == "" {
+		return
+	}
+	saved, err := cache.Save(config.CacheFile)
+	if err != nil {
+		Errorf("Can't save cache snapshot %s: %v", config.CacheFile, err)
+		return
+	}
+	Infof("Saved %d cache entries to %s", saved, config.CacheFile)
+}
+
+// startCacheSnapshots writes the cache to the cache-file every
+// cache-save-interval minutes, so a crash loses no more than that. The
+// returned function stops the snapshots.
+func startCacheSnapshots(mainContext context.Context, config *ConfigInstance, cache *Cache) context.CancelFunc {
+	if config.CacheFile == "" || config.CacheSaveEvery <= 0 {
+		return func() {}
+	}
+	snapshotContext, stop := context.WithCancel(mainContext)
+	go func() {
+		ticker := time.NewTicker(time.Minute * config.CacheSaveEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-snapshotContext.Done():
+				return
+			case <-ticker.C:
+				saved, err := cache.Save(config.CacheFile)
+				if err != nil {
+					Errorf("Can't save cache snapshot %s: %v", config.CacheFile, err)
+					continue
+				}
+				Debugf("Saved %d cache entries to %s", saved, config.CacheFile)
+			}
+		}
+	}()
+	return stop
+}
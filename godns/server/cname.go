@@ -0,0 +1,102 @@
+package server
+
+import (
+	. "godns/cache"
+	. "godns/config"
+
+	"github.com/google/gopacket/layers"
+)
+
+// maxCNAMEChain limits how many aliases are followed for one question.
+const maxCNAMEChain = 12
+
+// followCNAMEs walks the CNAME chain in the answers starting at name. It
+// returns the last name of the chain and whether records of rrType were found
+// there. A chain that comes back to a name it has already passed is a loop.
+func followCNAMEs(name string, rrType layers.DNSType, answers []layers.DNSResourceRecord) (target string, found bool, loop bool) {
+	target = canonicalName(name)
+	seen := make(map[string]bool)
+	for {
+		var alias string
+		for _, rr := range answers {
+			if canonicalName(string(rr.Name)) != target {
+				continue
+			}
+			if rr.Type == rrType {
+				return target, true, false
+			}
+			if rr.Type == layers.DNSTypeCNAME {
+				alias = canonicalName(string(rr.CNAME))
+			}
+		}
+		if alias == "" {
+			return target, false, false
+		}
+		if seen[target] {
+			return target, false, true
+		}
+		seen[target] = true
+		target = alias
+	}
+}
+
+// chaseCNAMEs completes a CNAME chain that the authoritative servers left
+// unfinished, usually because the target lives in another zone. The answer
+// section of the result holds the whole chain followed by the records of the
+// target, while the response code and the other sections come from the last
+// lookup. Loops and overlong chains are answered with SERVFAIL.
+func chaseCNAMEs(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, dnsResponse layers.DNS, cache *Cache, trace *queryTrace) (layers.DNS, bool) {
+	question := dnsIntReq.Questions[0]
+	if question.Type == layers.DNSTypeCNAME || question.Type == dnsTypeANY {
+		return dnsResponse, true
+	}
+
+	for hops := 0; hops <= maxCNAMEChain; hops++ {
+		if dnsResponse.ResponseCode != layers.DNSResponseCodeNoErr {
+			return dnsResponse, true
+		}
+		target, found, loop := followCNAMEs(string(question.Name), question.Type, dnsResponse.Answers)
+		if loop {
+			return getErrorResponse(dnsIntReq, layers.DNSResponseCodeServFail), true
+		}
+		if found || target == canonicalName(string(question.Name)) {
+			return dnsResponse, true
+		}
+		if len(getRecordsOfType(dnsResponse.Authorities, layers.DNSTypeSOA)) > 0 {
+			// The zone of the target says it has no such records.
+			return dnsResponse, true
+		}
+
+		targetReq := dnsIntReq
+		targetReq.Questions = []layers.DNSQuestion{{
+			Name:  []byte(target),
+			Type:  question.Type,
+			Class: question.Class,
+		}}
+		targetResponse, ok := lookupChainTarget(handler, state, getRebuiltDNSPacket(targetReq), cache, trace)
+		if !ok {
+			return layers.DNS{}, false
+		}
+
+		dnsResponse.ResponseCode = targetResponse.ResponseCode
+		dnsResponse.Answers = append(dnsResponse.Answers, targetResponse.Answers...)
+		dnsResponse.Authorities = targetResponse.Authorities
+		dnsResponse.Additionals = targetResponse.Additionals
+	}
+	return getErrorResponse(dnsIntReq, layers.DNSResponseCodeServFail), true
+}
+
+// lookupChainTarget resolves one link of a CNAME chain, from the local zones,
+// the cache or the upstream servers. Unlike lookupDNSPacket it neither chases
+// the chain further nor caches the partial result, so loops across zones are
+// left to chaseCNAMEs to detect.
+func lookupChainTarget(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, trace *queryTrace) (layers.DNS, bool) {
+	if dnsResponse, ok := getLocalResponse(dnsIntReq); ok {
+		return dnsResponse, true
+	}
+	question := dnsIntReq.Questions[0]
+	if item, found := cache.GetItem(NewKey(question.Name, question.Type, question.Class)); found {
+		return getCachedReply(dnsIntReq, item), true
+	}
+	return resolveDNSPacket(handler, state, dnsIntReq, cache, trace)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	. "godns/config"
+)
+
+// forwardRule sends the names at and below domain to its own upstreams.
+type forwardRule struct {
+	domain    string
+	forwarder *forwarder
+}
+
+// forwardRules are the conditional forwarding rules in the order of the
+// config.
+type forwardRules []forwardRule
+
+func newForwardRules(configs []ConditionalForwardConfig) (forwardRules, error) {
+	var rules forwardRules
+	for _, ruleConf := range configs {
+		if len(ruleConf.Upstreams) == 0 {
+			rules.close()
+			return nil, fmt.Errorf("%s: no upstreams", ruleConf.Domain)
+		}
+		fwd, err := newForwarder(ruleConf.ForwardConfig)
+		if err != nil {
+			rules.close()
+			return nil, fmt.Errorf("%s: %v", ruleConf.Domain, err)
+		}
+		rules = append(rules, forwardRule{
+			domain:    canonicalName(ruleConf.Domain),
+			forwarder: fwd,
+		})
+	}
+	return rules, nil
+}
+
+// close drops the pooled connections of the upstreams of every rule.
+func (rules forwardRules) close() {
+	for _, rule := range rules {
+		rule.forwarder.close()
+	}
+}
+
+// match returns the forwarder of the rule with the longest domain that name
+// belongs to, the first one of the config on a tie, or nil when no rule
+// matches.
+func (rules forwardRules) match(name string) *forwarder {
+	name = canonicalName(name)
+	var matched *forwarder
+	longest := -1
+	for _, rule := range rules {
+		if !isSubdomain(name, rule.domain) {
+			continue
+		}
+		if labels := len(nameLabels(rule.domain)); labels > longest {
+			matched, longest = rule.forwarder, labels
+		}
+	}
+	return matched
+}
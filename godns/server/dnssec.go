@@ -0,0 +1,678 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// DNSSEC record parsing and signature checks (RFC 4034, RFC 4035, RFC 5155).
+// Records of these types are kept by gopacket as raw RDATA only, so they are
+// decoded here from rr.Data.
+
+const (
+	dnskeyFlagZone  = 0x0100
+	nsec3FlagOptOut = 0x01
+
+	// RFC 9276 recommends treating larger iteration counts as insecure.
+	maxNSEC3Iterations = 150
+)
+
+var base32HexNoPadding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type dnskeyRecord struct {
+	flags     uint16
+	protocol  uint8
+	algorithm uint8
+	publicKey []byte
+	rdata     []byte
+}
+
+type dsRecord struct {
+	keyTag     uint16
+	algorithm  uint8
+	digestType uint8
+	digest     []byte
+}
+
+type rrsigRecord struct {
+	typeCovered layers.DNSType
+	algorithm   uint8
+	labels      uint8
+	originalTTL uint32
+	expiration  uint32
+	inception   uint32
+	keyTag      uint16
+	signerName  string
+	signature   []byte
+	header      []byte
+}
+
+type nsecRecord struct {
+	owner    string
+	nextName string
+	types    map[layers.DNSType]bool
+}
+
+type nsec3Record struct {
+	owner      string
+	ownerHash  []byte
+	hashAlg    uint8
+	flags      uint8
+	iterations uint16
+	salt       []byte
+	nextHash   []byte
+	types      map[layers.DNSType]bool
+}
+
+func parseDNSKEY(rr layers.DNSResourceRecord) (dnskeyRecord, bool) {
+	if rr.Type != dnsTypeDNSKEY || len(rr.Data) < 5 {
+		return dnskeyRecord{}, false
+	}
+	return dnskeyRecord{
+		flags:     binary.BigEndian.Uint16(rr.Data[0:2]),
+		protocol:  rr.Data[2],
+		algorithm: rr.Data[3],
+		publicKey: rr.Data[4:],
+		rdata:     rr.Data,
+	}, true
+}
+
+// keyTag computes the key tag of RFC 4034 Appendix B.
+func (key dnskeyRecord) keyTag() uint16 {
+	var ac uint32
+	for i, b := range key.rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac & 0xFFFF)
+}
+
+func parseDS(rr layers.DNSResourceRecord) (dsRecord, bool) {
+	if rr.Type != dnsTypeDS || len(rr.Data) < 5 {
+		return dsRecord{}, false
+	}
+	return dsRecord{
+		keyTag:     binary.BigEndian.Uint16(rr.Data[0:2]),
+		algorithm:  rr.Data[2],
+		digestType: rr.Data[3],
+		digest:     rr.Data[4:],
+	}, true
+}
+
+// parseTrustAnchor reads a DS record in presentation format, such as
+// ". 20326 8 2 E06D44B8...". The optional TTL, class and type fields are
+// skipped, and the digest may be split by spaces.
+func parseTrustAnchor(anchor string) (string, dsRecord, error) {
+	var fields []string
+	for i, field := range strings.Fields(anchor) {
+		if i > 0 && len(fields) == 1 && (strings.EqualFold(field, "IN") || strings.EqualFold(field, "DS")) {
+			continue
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) < 5 {
+		return "", dsRecord{}, errors.New("trust anchor must look like '<owner> <key tag> <algorithm> <digest type> <digest>'")
+	}
+	keyTag, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return "", dsRecord{}, err
+	}
+	algorithm, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil {
+		return "", dsRecord{}, err
+	}
+	digestType, err := strconv.ParseUint(fields[3], 10, 8)
+	if err != nil {
+		return "", dsRecord{}, err
+	}
+	digest, err := hex.DecodeString(strings.Join(fields[4:], ""))
+	if err != nil {
+		return "", dsRecord{}, err
+	}
+	return canonicalName(fields[0]), dsRecord{
+		keyTag:     uint16(keyTag),
+		algorithm:  uint8(algorithm),
+		digestType: uint8(digestType),
+		digest:     digest,
+	}, nil
+}
+
+// matches reports whether the DS record refers to the given DNSKEY of owner.
+func (ds dsRecord) matches(owner string, key dnskeyRecord) bool {
+	if ds.keyTag != key.keyTag() || ds.algorithm != key.algorithm {
+		return false
+	}
+	data := appendName(nil, []byte(canonicalName(owner)))
+	data = append(data, key.rdata...)
+
+	var digest []byte
+	switch ds.digestType {
+	case 1:
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	case 2:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case 4:
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(digest, ds.digest)
+}
+
+func isSupportedDigest(digestType uint8) bool {
+	return digestType == 1 || digestType == 2 || digestType == 4
+}
+
+func isSupportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case 5, 7, 8, 10, 13, 14, 15:
+		return true
+	}
+	return false
+}
+
+func parseRRSIG(rr layers.DNSResourceRecord) (rrsigRecord, bool) {
+	if rr.Type != dnsTypeRRSIG || len(rr.Data) < 19 {
+		return rrsigRecord{}, false
+	}
+	signerName, end, ok := readWireName(rr.Data, 18)
+	if !ok {
+		return rrsigRecord{}, false
+	}
+	return rrsigRecord{
+		typeCovered: layers.DNSType(binary.BigEndian.Uint16(rr.Data[0:2])),
+		algorithm:   rr.Data[2],
+		labels:      rr.Data[3],
+		originalTTL: binary.BigEndian.Uint32(rr.Data[4:8]),
+		expiration:  binary.BigEndian.Uint32(rr.Data[8:12]),
+		inception:   binary.BigEndian.Uint32(rr.Data[12:16]),
+		keyTag:      binary.BigEndian.Uint16(rr.Data[16:18]),
+		signerName:  canonicalName(signerName),
+		signature:   rr.Data[end:],
+		header:      rr.Data[:18],
+	}, true
+}
+
+func parseNSEC(rr layers.DNSResourceRecord) (nsecRecord, bool) {
+	if rr.Type != dnsTypeNSEC {
+		return nsecRecord{}, false
+	}
+	nextName, end, ok := readWireName(rr.Data, 0)
+	if !ok {
+		return nsecRecord{}, false
+	}
+	types, ok := parseTypeBitmap(rr.Data[end:])
+	if !ok {
+		return nsecRecord{}, false
+	}
+	return nsecRecord{owner: canonicalName(string(rr.Name)), nextName: canonicalName(nextName), types: types}, true
+}
+
+func parseNSEC3(rr layers.DNSResourceRecord) (nsec3Record, bool) {
+	data := rr.Data
+	if rr.Type != dnsTypeNSEC3 || len(data) < 5 {
+		return nsec3Record{}, false
+	}
+	owner := canonicalName(string(rr.Name))
+	if owner == "" {
+		return nsec3Record{}, false
+	}
+	ownerHash, err := base32HexNoPadding.DecodeString(strings.ToUpper(nameLabels(owner)[0]))
+	if err != nil {
+		return nsec3Record{}, false
+	}
+	record := nsec3Record{
+		owner:      owner,
+		ownerHash:  ownerHash,
+		hashAlg:    data[0],
+		flags:      data[1],
+		iterations: binary.BigEndian.Uint16(data[2:4]),
+	}
+	offset := 5 + int(data[4])
+	if len(data) < offset+1 {
+		return nsec3Record{}, false
+	}
+	record.salt = data[5:offset]
+	hashEnd := offset + 1 + int(data[offset])
+	if len(data) < hashEnd {
+		return nsec3Record{}, false
+	}
+	record.nextHash = data[offset+1 : hashEnd]
+	types, ok := parseTypeBitmap(data[hashEnd:])
+	if !ok {
+		return nsec3Record{}, false
+	}
+	record.types = types
+	return record, true
+}
+
+func parseTypeBitmap(data []byte) (map[layers.DNSType]bool, bool) {
+	types := make(map[layers.DNSType]bool)
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, false
+		}
+		window, length := int(data[0]), int(data[1])
+		for i, b := range data[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types[layers.DNSType(window<<8|i<<3|bit)] = true
+				}
+			}
+		}
+		data = data[2+length:]
+	}
+	return types, true
+}
+
+// readWireName reads an uncompressed domain name, as found in the RDATA of
+// DNSSEC records.
+func readWireName(data []byte, offset int) (string, int, bool) {
+	var labels []string
+	for {
+		if offset >= len(data) {
+			return "", 0, false
+		}
+		length := int(data[offset])
+		offset++
+		if length == 0 {
+			return strings.Join(labels, "."), offset, true
+		}
+		if length > 63 || offset+length > len(data) {
+			return "", 0, false
+		}
+		labels = append(labels, string(data[offset:offset+length]))
+		offset += length
+	}
+}
+
+// verifyRRSIG checks the signature over an RRset with one DNSKEY. The signed
+// data is built as described in RFC 4034 section 3.1.8.1, with the RRs in
+// canonical form and order.
+func verifyRRSIG(rrset []layers.DNSResourceRecord, sig rrsigRecord, key dnskeyRecord, now time.Time) bool {
+	if len(rrset) == 0 || key.algorithm != sig.algorithm || key.protocol != 3 || key.flags&dnskeyFlagZone == 0 {
+		return false
+	}
+	if !isWithinValidityPeriod(sig, now) {
+		return false
+	}
+
+	owner := canonicalName(string(rrset[0].Name))
+	ownerLabels := nameLabels(owner)
+	if int(sig.labels) > len(ownerLabels) || !isSubdomain(owner, sig.signerName) {
+		return false
+	}
+	if int(sig.labels) < len(ownerLabels) {
+		owner = "*." + strings.Join(ownerLabels[len(ownerLabels)-int(sig.labels):], ".")
+		owner = strings.TrimSuffix(owner, ".")
+	}
+
+	signed := append([]byte(nil), sig.header...)
+	signed = appendName(signed, []byte(sig.signerName))
+
+	var canonicalRRs [][]byte
+	for _, rr := range rrset {
+		var wire []byte
+		wire = appendName(wire, []byte(owner))
+		wire = appendUint16(wire, uint16(rr.Type))
+		wire = appendUint16(wire, uint16(rr.Class))
+		wire = appendUint32(wire, sig.originalTTL)
+		rdata := canonicalRData(rr)
+		wire = appendUint16(wire, uint16(len(rdata)))
+		wire = append(wire, rdata...)
+		canonicalRRs = append(canonicalRRs, wire)
+	}
+	sort.Slice(canonicalRRs, func(i, j int) bool {
+		return bytes.Compare(canonicalRRs[i], canonicalRRs[j]) < 0
+	})
+	for i, wire := range canonicalRRs {
+		if i > 0 && bytes.Equal(wire, canonicalRRs[i-1]) {
+			continue
+		}
+		signed = append(signed, wire...)
+	}
+
+	return verifySignature(key, signed, sig.signature)
+}
+
+// isWithinValidityPeriod compares timestamps in serial number arithmetic
+// (RFC 1982), as RFC 4034 section 3.1.5 requires.
+func isWithinValidityPeriod(sig rrsigRecord, now time.Time) bool {
+	current := uint32(now.Unix())
+	return int32(current-sig.inception) >= 0 && int32(sig.expiration-current) >= 0
+}
+
+// canonicalRData returns the RDATA with embedded names lowercased, for the
+// types listed in RFC 4034 section 6.2.
+func canonicalRData(rr layers.DNSResourceRecord) []byte {
+	switch rr.Type {
+	case layers.DNSTypeNS:
+		rr.NS = []byte(canonicalName(string(rr.NS)))
+	case layers.DNSTypeCNAME:
+		rr.CNAME = []byte(canonicalName(string(rr.CNAME)))
+	case layers.DNSTypePTR:
+		rr.PTR = []byte(canonicalName(string(rr.PTR)))
+	case layers.DNSTypeSOA:
+		rr.SOA.MName = []byte(canonicalName(string(rr.SOA.MName)))
+		rr.SOA.RName = []byte(canonicalName(string(rr.SOA.RName)))
+	case layers.DNSTypeMX:
+		rr.MX.Name = []byte(canonicalName(string(rr.MX.Name)))
+	case layers.DNSTypeSRV:
+		rr.SRV.Name = []byte(canonicalName(string(rr.SRV.Name)))
+	default:
+		return rr.Data
+	}
+	return appendRData(nil, &rr)
+}
+
+func verifySignature(key dnskeyRecord, signed []byte, signature []byte) bool {
+	switch key.algorithm {
+	case 5, 7:
+		return verifyRSA(key.publicKey, crypto.SHA1, signed, signature)
+	case 8:
+		return verifyRSA(key.publicKey, crypto.SHA256, signed, signature)
+	case 10:
+		return verifyRSA(key.publicKey, crypto.SHA512, signed, signature)
+	case 13:
+		return verifyECDSA(key.publicKey, elliptic.P256(), crypto.SHA256, signed, signature)
+	case 14:
+		return verifyECDSA(key.publicKey, elliptic.P384(), crypto.SHA384, signed, signature)
+	case 15:
+		if len(key.publicKey) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(ed25519.PublicKey(key.publicKey), signed, signature)
+	}
+	return false
+}
+
+// verifyRSA decodes the public key format of RFC 3110: an exponent length,
+// the exponent and the modulus.
+func verifyRSA(publicKey []byte, hash crypto.Hash, signed []byte, signature []byte) bool {
+	if len(publicKey) < 3 {
+		return false
+	}
+	expLen, offset := int(publicKey[0]), 1
+	if expLen == 0 {
+		expLen, offset = int(binary.BigEndian.Uint16(publicKey[1:3])), 3
+	}
+	if expLen > 4 || len(publicKey) <= offset+expLen {
+		return false
+	}
+	var exponent int
+	for _, b := range publicKey[offset : offset+expLen] {
+		exponent = exponent<<8 | int(b)
+	}
+	key := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(publicKey[offset+expLen:]),
+		E: exponent,
+	}
+
+	hasher := hash.New()
+	hasher.Write(signed)
+	return rsa.VerifyPKCS1v15(key, hash, hasher.Sum(nil), signature) == nil
+}
+
+// verifyECDSA decodes the key and signature formats of RFC 6605, which are
+// plain concatenations of the two coordinates and of r and s.
+func verifyECDSA(publicKey []byte, curve elliptic.Curve, hash crypto.Hash, signed []byte, signature []byte) bool {
+	size := (curve.Params().BitSize + 7) / 8
+	if len(publicKey) != 2*size || len(signature) != 2*size {
+		return false
+	}
+	key := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(publicKey[:size]),
+		Y:     new(big.Int).SetBytes(publicKey[size:]),
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	return ecdsa.Verify(key, hasher.Sum(nil), r, s)
+}
+
+// nsecCovers reports whether the name falls strictly between the owner and
+// the next name of the NSEC record. The last NSEC of a zone points back to
+// the apex and covers everything after its owner.
+func nsecCovers(nsec nsecRecord, name string) bool {
+	if compareNames(nsec.owner, nsec.nextName) < 0 {
+		return compareNames(nsec.owner, name) < 0 && compareNames(name, nsec.nextName) < 0
+	}
+	return compareNames(nsec.owner, name) < 0 && isSubdomain(name, nsec.nextName)
+}
+
+// nsecProvesNoData looks for an NSEC record at the name itself, or for a
+// wildcard NSEC at its closest encloser, that lacks both the type and CNAME.
+// An NSEC covering the name and pointing below it proves an empty
+// non-terminal, which has no records at all.
+func nsecProvesNoData(nsecs []nsecRecord, name string, qtype layers.DNSType) bool {
+	for _, nsec := range nsecs {
+		if nsec.owner == name {
+			return !nsec.types[qtype] && !nsec.types[layers.DNSTypeCNAME]
+		}
+	}
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		if isSubdomain(nsec.nextName, name) {
+			return true
+		}
+		wildcard := wildcardName(nsecClosestEncloser(nsec, name))
+		for _, wild := range nsecs {
+			if wild.owner == wildcard {
+				return !wild.types[qtype] && !wild.types[layers.DNSTypeCNAME]
+			}
+		}
+	}
+	return false
+}
+
+// nsecProvesNXDomain needs one NSEC covering the name and one showing that no
+// wildcard could have matched it (RFC 4035 section 5.4).
+func nsecProvesNXDomain(nsecs []nsecRecord, name string) bool {
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		wildcard := wildcardName(nsecClosestEncloser(nsec, name))
+		for _, wild := range nsecs {
+			if nsecCovers(wild, wildcard) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsecClosestEncloser derives the closest existing ancestor of a name that
+// is covered by the NSEC record.
+func nsecClosestEncloser(nsec nsecRecord, name string) string {
+	encloser := commonAncestor(name, nsec.owner)
+	if next := commonAncestor(name, nsec.nextName); len(next) > len(encloser) {
+		encloser = next
+	}
+	return encloser
+}
+
+func nsec3Hash(name string, nsec3 nsec3Record) []byte {
+	data := appendName(nil, []byte(canonicalName(name)))
+	hasher := sha1.New()
+	hasher.Write(data)
+	hasher.Write(nsec3.salt)
+	digest := hasher.Sum(nil)
+	for i := 0; i < int(nsec3.iterations); i++ {
+		hasher.Reset()
+		hasher.Write(digest)
+		hasher.Write(nsec3.salt)
+		digest = hasher.Sum(nil)
+	}
+	return digest
+}
+
+func nsec3Matches(nsec3 nsec3Record, name string) bool {
+	return bytes.Equal(nsec3.ownerHash, nsec3Hash(name, nsec3))
+}
+
+func nsec3Covers(nsec3 nsec3Record, name string) bool {
+	hash := nsec3Hash(name, nsec3)
+	if bytes.Compare(nsec3.ownerHash, nsec3.nextHash) < 0 {
+		return bytes.Compare(nsec3.ownerHash, hash) < 0 && bytes.Compare(hash, nsec3.nextHash) < 0
+	}
+	return bytes.Compare(nsec3.ownerHash, hash) < 0 || bytes.Compare(hash, nsec3.nextHash) < 0
+}
+
+// usableNSEC3 drops records with an unknown hash algorithm or with too many
+// iterations, and records that do not belong to the zone.
+func usableNSEC3(nsec3s []nsec3Record, zone string) []nsec3Record {
+	var usable []nsec3Record
+	for _, nsec3 := range nsec3s {
+		if nsec3.hashAlg == 1 && nsec3.iterations <= maxNSEC3Iterations && parentName(nsec3.owner) == zone {
+			usable = append(usable, nsec3)
+		}
+	}
+	return usable
+}
+
+// nsec3ClosestEncloser implements the closest encloser proof of RFC 5155
+// section 8.3. It returns the closest encloser, the next closer name and the
+// NSEC3 record covering the latter.
+func nsec3ClosestEncloser(nsec3s []nsec3Record, name string) (string, string, nsec3Record, bool) {
+	labels := nameLabels(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := strings.Join(labels[i:], ".")
+		nextCloser := strings.Join(labels[i-1:], ".")
+		for _, match := range nsec3s {
+			if !nsec3Matches(match, encloser) {
+				continue
+			}
+			for _, cover := range nsec3s {
+				if nsec3Covers(cover, nextCloser) {
+					return encloser, nextCloser, cover, true
+				}
+			}
+			return "", "", nsec3Record{}, false
+		}
+	}
+	return "", "", nsec3Record{}, false
+}
+
+// nsec3ProvesNoData returns whether NODATA is proven for the name and type,
+// and whether the proof relies on an opt-out span, which makes the answer
+// insecure rather than secure (RFC 5155 section 8.5 to 8.7).
+func nsec3ProvesNoData(nsec3s []nsec3Record, name string, qtype layers.DNSType) (bool, bool) {
+	for _, nsec3 := range nsec3s {
+		if nsec3Matches(nsec3, name) {
+			return !nsec3.types[qtype] && !nsec3.types[layers.DNSTypeCNAME], false
+		}
+	}
+	encloser, _, cover, ok := nsec3ClosestEncloser(nsec3s, name)
+	if !ok {
+		return false, false
+	}
+	if qtype == dnsTypeDS && cover.flags&nsec3FlagOptOut != 0 {
+		return true, true
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3Matches(nsec3, wildcardName(encloser)) {
+			return !nsec3.types[qtype] && !nsec3.types[layers.DNSTypeCNAME], false
+		}
+	}
+	return false, false
+}
+
+// nsec3ProvesNXDomain needs the closest encloser proof and an NSEC3 covering
+// the wildcard at the closest encloser. An opt-out span over the next closer
+// name only proves that no signed name exists there.
+func nsec3ProvesNXDomain(nsec3s []nsec3Record, name string) (bool, bool) {
+	encloser, _, cover, ok := nsec3ClosestEncloser(nsec3s, name)
+	if !ok {
+		return false, false
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3Covers(nsec3, wildcardName(encloser)) {
+			return true, cover.flags&nsec3FlagOptOut != 0
+		}
+	}
+	return false, false
+}
+
+// canonicalName lowercases a name and strips the trailing dot. The root is
+// represented by an empty string, as gopacket does.
+func canonicalName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return name
+}
+
+func nameLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+func parentName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+func wildcardName(encloser string) string {
+	if encloser == "" {
+		return "*"
+	}
+	return "*." + encloser
+}
+
+func isSubdomain(child string, parent string) bool {
+	return parent == "" || child == parent || strings.HasSuffix(child, "."+parent)
+}
+
+func commonAncestor(a string, b string) string {
+	labelsA, labelsB := nameLabels(a), nameLabels(b)
+	common := 0
+	for common < len(labelsA) && common < len(labelsB) &&
+		labelsA[len(labelsA)-1-common] == labelsB[len(labelsB)-1-common] {
+		common++
+	}
+	return strings.Join(labelsA[len(labelsA)-common:], ".")
+}
+
+// compareNames orders names canonically (RFC 4034 section 6.1): label by
+// label starting from the rightmost one.
+func compareNames(a string, b string) int {
+	labelsA, labelsB := nameLabels(a), nameLabels(b)
+	for i := 1; i <= len(labelsA) && i <= len(labelsB); i++ {
+		if c := bytes.Compare([]byte(labelsA[len(labelsA)-i]), []byte(labelsB[len(labelsB)-i])); c != 0 {
+			return c
+		}
+	}
+	return len(labelsA) - len(labelsB)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "godns/config"
+	. "godns/dnstap"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const dnstapVersion = "godns"
+
+// dnstapTap is the dnstap output and the message types sent to it. The taps
+// of successive configs share the output while it goes to the same place;
+// users counts them.
+type dnstapTap struct {
+	output   *Output
+	users    *int32
+	identity string
+	messages map[MessageType]bool
+}
+
+var transportProtocols = map[string]SocketProtocol{
+	transportUDP: ProtocolUDP,
+	transportTCP: ProtocolTCP,
+	transportDoT: ProtocolDoT,
+	transportDoH: ProtocolDoH,
+}
+
+// openDnstap prepares the dnstap output for the config. The output of current
+// is kept when it goes to the same place, so a reload neither truncates the
+// file nor reconnects to the collector.
+func openDnstap(config *ConfigInstance, mainContext context.Context, current *dnstapTap) (*dnstapTap, error) {
+	network, address, err := getDnstapTarget(config.Dnstap)
+	if err != nil || network == "" {
+		return nil, err
+	}
+
+	messages := make(map[MessageType]bool)
+	for _, name := range config.Dnstap.Messages {
+		messageType, ok := ParseMessageType(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown dnstap message type %s", name)
+		}
+		messages[messageType] = true
+	}
+	if len(messages) == 0 {
+		messages = map[MessageType]bool{ClientQuery: true, ClientResponse: true, ResolverQuery: true, ResolverResponse: true}
+	}
+
+	identity := config.Dnstap.Identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+
+	if current != nil && current.identity == identity && current.output.String() == network+":"+address {
+		atomic.AddInt32(current.users, 1)
+		return &dnstapTap{output: current.output, users: current.users, identity: identity, messages: messages}, nil
+	}
+	output, err := NewOutput(mainContext, network, address, identity, dnstapVersion)
+	if err != nil {
+		return nil, err
+	}
+	users := int32(1)
+	return &dnstapTap{output: output, users: &users, identity: identity, messages: messages}, nil
+}
+
+func getDnstapTarget(dnstapConf DnstapConfig) (string, string, error) {
+	network, address := "", ""
+	for _, target := range []struct{ network, address string }{
+		{"unix", dnstapConf.Socket},
+		{"tcp", dnstapConf.TCP},
+		{"file", dnstapConf.File},
+	} {
+		if target.address == "" {
+			continue
+		}
+		if network != "" {
+			return "", "", errors.New("only one of socket, tcp and file can be set")
+		}
+		network, address = target.network, target.address
+	}
+	return network, address, nil
+}
+
+// closeDnstap ends the stream of tap unless another tap still writes to it.
+func closeDnstap(tap *dnstapTap) {
+	if tap != nil && atomic.AddInt32(tap.users, -1) == 0 {
+		tap.output.Close()
+	}
+}
+
+func (t *dnstapTap) wants(messageType MessageType) bool {
+	return t != nil && t.messages[messageType]
+}
+
+// tapClientQuery sends a query as it arrived from a client to current, the
+// dnstap output of the query. Like the other tap functions it does nothing
+// when current is nil, that is when dnstap is off.
+func tapClientQuery(current *dnstapTap, dnsIntReq layers.DNS, transport string, client string, queryTime time.Time) {
+	if !current.wants(ClientQuery) {
+		return
+	}
+	clientIP, clientPort := splitAddress(client)
+	current.output.Send(&Message{
+		Type:         ClientQuery,
+		Protocol:     transportProtocols[transport],
+		QueryAddress: clientIP,
+		QueryPort:    clientPort,
+		QueryTime:    queryTime,
+		QueryMessage: dnsIntReq.Contents,
+	})
+}
+
+// tapClientResponse sends the response to a client query. The response is
+// packed as it would be sent over a stream transport, so a UDP response that
+// was truncated shows up in full.
+func tapClientResponse(current *dnstapTap, handler *ConfigHandler, dnsIntReq layers.DNS, dnsResponse layers.DNS, transport string, client string, queryTime time.Time) {
+	if !current.wants(ClientResponse) {
+		return
+	}
+	clientIP, clientPort := splitAddress(client)
+	current.output.Send(&Message{
+		Type:            ClientResponse,
+		Protocol:        transportProtocols[transport],
+		QueryAddress:    clientIP,
+		QueryPort:       clientPort,
+		QueryTime:       queryTime,
+		ResponseTime:    time.Now(),
+		QueryMessage:    dnsIntReq.Contents,
+		ResponseMessage: getClientResponse(handler.Get(), dnsIntReq, dnsResponse, maxTCPMessageSize),
+	})
+}
+
+// tapResolverQuery sends a query this server made to another server over
+// extConn.
+func tapResolverQuery(current *dnstapTap, extConn net.Conn, protocol SocketProtocol, query []byte, queryTime time.Time) {
+	if !current.wants(ResolverQuery) {
+		return
+	}
+	message := getResolverMessage(extConn, protocol, query, queryTime)
+	message.Type = ResolverQuery
+	current.output.Send(message)
+}
+
+// tapResolverResponse sends the answer another server gave to a query this
+// server made.
+func tapResolverResponse(current *dnstapTap, extConn net.Conn, protocol SocketProtocol, query []byte, queryTime time.Time, response []byte) {
+	if !current.wants(ResolverResponse) {
+		return
+	}
+	message := getResolverMessage(extConn, protocol, query, queryTime)
+	message.Type = ResolverResponse
+	message.ResponseTime = time.Now()
+	message.ResponseMessage = response
+	current.output.Send(message)
+}
+
+func getResolverMessage(extConn net.Conn, protocol SocketProtocol, query []byte, queryTime time.Time) *Message {
+	localIP, localPort := splitAddress(extConn.LocalAddr().String())
+	remoteIP, remotePort := splitAddress(extConn.RemoteAddr().String())
+	return &Message{
+		Protocol:        protocol,
+		QueryAddress:    localIP,
+		QueryPort:       localPort,
+		ResponseAddress: remoteIP,
+		ResponsePort:    remotePort,
+		QueryTime:       queryTime,
+		QueryMessage:    query,
+	}
+}
+
+// splitAddress returns the IP and port of a host:port address, nil if the
+// host is not an IP.
+func splitAddress(address string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0
+	}
+	portNumber, _ := strconv.Atoi(port)
+	return net.ParseIP(host), portNumber
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+)
+
+// listenDoH opens the DNS-over-HTTPS listener. It returns nil without an error
+// when doh-port is not configured.
+func listenDoH(config *ConfigInstance) (net.Listener, error) {
+	if config.DoHPort == 0 {
+		return nil, nil
+	}
+	if getServerState().certificates == nil {
+		return nil, errors.New("tls-cert and tls-key are required for DNS-over-HTTPS")
+	}
+	return net.Listen("tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.DoHPort)))
+}
+
+// serveDoH answers RFC 8484 queries on the listener until listenContext is
+// done.
+func serveDoH(handler *ConfigHandler, listenContext context.Context, listener net.Listener, cache *Cache) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, func(w http.ResponseWriter, r *http.Request) {
+		serveDoHRequest(handler, cache, w, r)
+	})
+	httpServer := &http.Server{
+		Handler:      mux,
+		TLSConfig:    serverTLSConfig,
+		ReadTimeout:  time.Second * 5,
+		WriteTimeout: time.Second * 5,
+		IdleTimeout:  handler.Get().TCPIdleTimeout * time.Second,
+	}
+
+	go func() {
+		<-listenContext.Done()
+		httpServer.Close()
+	}()
+
+	err := httpServer.ServeTLS(listener, "", "")
+	if err != nil && err != http.ErrServerClosed && listenContext.Err() == nil {
+		Errorf("DNS-over-HTTPS listener stopped: %v", err)
+	}
+}
+
+func serveDoHRequest(handler *ConfigHandler, cache *Cache, w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, maxTCPMessageSize+1))
+		if err == nil && len(data) > maxTCPMessageSize {
+			http.Error(w, "message is too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "malformed dns parameter", http.StatusBadRequest)
+		return
+	}
+	dnsIntReq, ok := decodeDNSPacket(data)
+	if !ok || dnsIntReq.QR || len(dnsIntReq.Questions) == 0 {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	state := acquireServerState()
+	defer state.release()
+	if clientIP, _ := splitAddress(r.RemoteAddr); state.rateLimits.limitQuery(clientIP, transportDoH) != rateAllow {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	dnsResponse := serveDNSPacket(handler, state, dnsIntReq, cache, transportDoH, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", dohContentType)
+	if maxAge, ok := getDoHMaxAge(dnsResponse); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge), 10))
+	}
+	w.Write(getClientResponse(handler.Get(), dnsIntReq, dnsResponse, maxTCPMessageSize))
+}
+
+// getDoHMaxAge picks the HTTP freshness lifetime of a response (RFC 8484
+// section 5.1): the smallest answer TTL, or the negative caching TTL from
+// the authority section when there are no answers.
+func getDoHMaxAge(dnsResponse layers.DNS) (uint32, bool) {
+	if len(withoutOPT(dnsResponse.Answers)) > 0 {
+		return MinTTL(dnsResponse.Answers), true
+	}
+	if isNegativeResponse(dnsResponse) {
+		maxAge := MinTTL(dnsResponse.Authorities)
+		for _, rr := range getRecordsOfType(dnsResponse.Authorities, layers.DNSTypeSOA) {
+			if rr.SOA.Minimum < maxAge {
+				maxAge = rr.SOA.Minimum
+			}
+		}
+		return maxAge, true
+	}
+	return 0, false
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	. "godns/config"
+	. "godns/dnstap"
+	. "godns/logger"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dotPort               = "853"
+	defaultDoTConnections = 2
+	dotQueryTimeout       = time.Second * 2
+)
+
+// dotConn is a persistent DNS-over-TLS connection (RFC 7858). Queries are
+// pipelined: each one gets an ID unique on the connection, and a single reader
+// hands the answers to the waiting queries as they arrive.
+type dotConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	nextID  uint16
+	closed  bool
+}
+
+// dotPool keeps up to size connections to one upstream and spreads queries
+// over the least loaded of them.
+type dotPool struct {
+	address   string
+	tlsConfig *tls.Config
+	size      int
+
+	mu     sync.Mutex
+	conns  []*dotConn
+	closed bool
+}
+
+func newDoTPool(upstreamConf UpstreamConfig) (*dotPool, error) {
+	pool := &dotPool{
+		address: getServerAddr(upstreamConf.Address, dotPort),
+		size:    upstreamConf.Connections,
+	}
+	if pool.size <= 0 {
+		pool.size = defaultDoTConnections
+	}
+
+	tlsConfig, err := getDoTClientConfig(upstreamConf)
+	if err != nil {
+		return nil, fmt.Errorf("can't set up TLS for upstream %s: %v", upstreamConf.Address, err)
+	}
+	pool.tlsConfig = tlsConfig
+	return pool, nil
+}
+
+// getDoTClientConfig builds the TLS settings for an upstream. Certificates are
+// checked against server-name, or against the address when it is not set, and
+// with SPKI pins configured one of the certificates in the chain must match.
+func getDoTClientConfig(upstreamConf UpstreamConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: upstreamConf.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(getServerAddr(upstreamConf.Address, dotPort))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+
+	if upstreamConf.CAFile != "" {
+		data, err := os.ReadFile(upstreamConf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + upstreamConf.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if len(upstreamConf.SPKIPins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range upstreamConf.SPKIPins {
+			pins[pin] = true
+		}
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(digest[:])] {
+					return nil
+				}
+			}
+			return errors.New("no certificate matches the SPKI pins")
+		}
+	}
+	return tlsConfig, nil
+}
+
+// exchange sends the query over one of the pooled connections and waits for
+// its answer. The response carries the ID of the original query.
+func (pool *dotPool) exchange(tap *dnstapTap, dnsIntReq layers.DNS) layers.DNS {
+	if pool.tlsConfig == nil || len(dnsIntReq.Contents) < 2 {
+		return layers.DNS{}
+	}
+
+	dc, err := pool.getConn()
+	if err != nil {
+		Warnf("Unable to establish TLS connection to External DNS server %s: %v", pool.address, err)
+		return layers.DNS{}
+	}
+
+	queryTime := time.Now()
+	tapResolverQuery(tap, dc.conn, ProtocolDoT, dnsIntReq.Contents, queryTime)
+	data, err := dc.exchange(dnsIntReq.Contents)
+	if err != nil {
+		Warnf("No answer from %s to %s over TLS: %v", pool.address, getQuestionText(dnsIntReq), err)
+		return layers.DNS{}
+	}
+
+	binary.BigEndian.PutUint16(data, dnsIntReq.ID)
+	tapResolverResponse(tap, dc.conn, ProtocolDoT, dnsIntReq.Contents, queryTime, data)
+	dnsResponse, ok := decodeDNSPacket(data)
+	if !ok {
+		return layers.DNS{}
+	}
+	return dnsResponse
+}
+
+func (pool *dotPool) getConn() (*dotConn, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closed {
+		return nil, errors.New("the connection pool is closed")
+	}
+
+	var best *dotConn
+	bestLoad := 0
+	live := pool.conns[:0]
+	for _, dc := range pool.conns {
+		load, closed := dc.load()
+		if closed {
+			continue
+		}
+		live = append(live, dc)
+		if best == nil || load < bestLoad {
+			best, bestLoad = dc, load
+		}
+	}
+	pool.conns = live
+
+	if best != nil && (bestLoad == 0 || len(pool.conns) >= pool.size) {
+		return best, nil
+	}
+
+	dc, err := dialDoT(pool.address, pool.tlsConfig)
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	pool.conns = append(pool.conns, dc)
+	return dc, nil
+}
+
+func (pool *dotPool) close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, dc := range pool.conns {
+		dc.conn.Close()
+	}
+	pool.conns = nil
+	pool.closed = true
+}
+
+func dialDoT(address string, tlsConfig *tls.Config) (*dotConn, error) {
+	dialer := &net.Dialer{Timeout: dotQueryTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	dc := &dotConn{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+	}
+	go dc.readResponses()
+	return dc, nil
+}
+
+func (dc *dotConn) load() (int, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return len(dc.pending), dc.closed
+}
+
+// readResponses delivers answers to the queries waiting for them until the
+// connection is closed by either side.
+func (dc *dotConn) readResponses() {
+	for {
+		data, err := readTCPMessage(dc.conn)
+		if err != nil {
+			break
+		}
+		if len(data) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(data)
+
+		dc.mu.Lock()
+		waiting, found := dc.pending[id]
+		delete(dc.pending, id)
+		dc.mu.Unlock()
+
+		if found {
+			waiting <- data
+		}
+	}
+
+	dc.conn.Close()
+	dc.mu.Lock()
+	dc.closed = true
+	for id, waiting := range dc.pending {
+		close(waiting)
+		delete(dc.pending, id)
+	}
+	dc.mu.Unlock()
+}
+
+func (dc *dotConn) exchange(query []byte) ([]byte, error) {
+	waiting := make(chan []byte, 1)
+
+	dc.mu.Lock()
+	if dc.closed {
+		dc.mu.Unlock()
+		return nil, errors.New("connection is closed")
+	}
+	id := dc.nextID
+	for {
+		if _, busy := dc.pending[id]; !busy {
+			break
+		}
+		id++
+	}
+	dc.nextID = id + 1
+	dc.pending[id] = waiting
+	dc.mu.Unlock()
+
+	message := make([]byte, len(query))
+	copy(message, query)
+	binary.BigEndian.PutUint16(message, id)
+
+	dc.writeMu.Lock()
+	dc.conn.SetWriteDeadline(time.Now().Add(dotQueryTimeout))
+	err := writeTCPMessage(dc.conn, message)
+	dc.writeMu.Unlock()
+	if err != nil {
+		dc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case data, ok := <-waiting:
+		if !ok {
+			return nil, errors.New("connection is closed")
+		}
+		return data, nil
+	case <-time.After(dotQueryTimeout):
+		dc.mu.Lock()
+		delete(dc.pending, id)
+		dc.mu.Unlock()
+		return nil, errors.New("timeout")
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	. "godns/config"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// dotStandIn is a DNS-over-TLS server on the loopback with a self-signed
+// certificate. Every connection it accepts is handed to serve.
+type dotStandIn struct {
+	address  string
+	caFile   string
+	pin      string
+	accepted int32
+}
+
+func startDoTStandIn(t *testing.T, serve func(conn net.Conn)) *dotStandIn {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dot.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	standIn := &dotStandIn{caFile: filepath.Join(t.TempDir(), "ca.pem")}
+	if err := os.WriteFile(standIn.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	standIn.pin = base64.StdEncoding.EncodeToString(digest[:])
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	standIn.address = listener.Addr().String()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&standIn.accepted, 1)
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return standIn
+}
+
+func (standIn *dotStandIn) upstreamConfig(pins ...string) UpstreamConfig {
+	return UpstreamConfig{
+		Address:     standIn.address,
+		Protocol:    protocolTLS,
+		CAFile:      standIn.caFile,
+		SPKIPins:    pins,
+		Connections: 1,
+	}
+}
+
+// serveDoTAnswers answers every query on conn in the order they come in.
+func serveDoTAnswers(conn net.Conn) {
+	for {
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		if writeTCPMessage(conn, getTestReply(query)) != nil {
+			return
+		}
+	}
+}
+
+// getTestReply echoes query back as a response.
+func getTestReply(query []byte) []byte {
+	reply := make([]byte, len(query))
+	copy(reply, query)
+	reply[2] |= 0x80
+	return reply
+}
+
+func getTestQuery(t *testing.T, id uint16, name string) layers.DNS {
+	t.Helper()
+	query, ok := decodeDNSPacket(packDNSMessage(layers.DNS{
+		ID: id,
+		RD: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		},
+	}))
+	if !ok {
+		t.Fatalf("can't decode the query for %s", name)
+	}
+	return query
+}
+
+func checkTestReply(t *testing.T, reply layers.DNS, id uint16, name string) {
+	t.Helper()
+	if !reply.QR || len(reply.Questions) != 1 {
+		t.Fatalf("no answer for %s", name)
+	}
+	if reply.ID != id || string(reply.Questions[0].Name) != name {
+		t.Errorf("got answer %d for %s, want %d for %s", reply.ID, reply.Questions[0].Name, id, name)
+	}
+}
+
+func TestDoTSPKIPins(t *testing.T) {
+	standIn := startDoTStandIn(t, serveDoTAnswers)
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	for _, test := range []struct {
+		name   string
+		pins   []string
+		answer bool
+	}{
+		{"no pins", nil, true},
+		{"matching pin", []string{otherPin, standIn.pin}, true},
+		{"other pin", []string{otherPin}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pool, err := newDoTPool(standIn.upstreamConfig(test.pins...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pool.close()
+
+			reply := pool.exchange(nil, getTestQuery(t, 0x1234, "www.example.test"))
+			if test.answer {
+				checkTestReply(t, reply, 0x1234, "www.example.test")
+			} else if reply.QR {
+				t.Error("got an answer from a server that doesn't match the pins")
+			}
+		})
+	}
+}
+
+func TestDoTPipelining(t *testing.T) {
+	// The stand-in takes two queries before it answers, and answers the
+	// second one first.
+	standIn := startDoTStandIn(t, func(conn net.Conn) {
+		first, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		second, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		writeTCPMessage(conn, getTestReply(second))
+		writeTCPMessage(conn, getTestReply(first))
+		serveDoTAnswers(conn)
+	})
+	pool, err := newDoTPool(standIn.upstreamConfig(standIn.pin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.close()
+
+	queries := []struct {
+		id   uint16
+		name string
+	}{
+		{0x1111, "one.example.test"},
+		{0x1111, "two.example.test"},
+	}
+	replies := make([]layers.DNS, len(queries))
+	var wg sync.WaitGroup
+	for i := range queries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replies[i] = pool.exchange(nil, getTestQuery(t, queries[i].id, queries[i].name))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, query := range queries {
+		checkTestReply(t, replies[i], query.id, query.name)
+	}
+	if accepted := atomic.LoadInt32(&standIn.accepted); accepted != 1 {
+		t.Errorf("the queries took %d connections, want 1", accepted)
+	}
+}
+
+func TestDoTRedial(t *testing.T) {
+	// The stand-in hangs up after every answer.
+	standIn := startDoTStandIn(t, func(conn net.Conn) {
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		writeTCPMessage(conn, getTestReply(query))
+	})
+	pool, err := newDoTPool(standIn.upstreamConfig(standIn.pin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.close()
+
+	checkTestReply(t, pool.exchange(nil, getTestQuery(t, 1, "one.example.test")), 1, "one.example.test")
+
+	pool.mu.Lock()
+	dc := pool.conns[0]
+	pool.mu.Unlock()
+	for deadline := time.Now().Add(dotQueryTimeout); ; time.Sleep(time.Millisecond) {
+		if _, closed := dc.load(); closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the hung up connection is not noticed")
+		}
+	}
+
+	checkTestReply(t, pool.exchange(nil, getTestQuery(t, 2, "two.example.test")), 2, "two.example.test")
+	if accepted := atomic.LoadInt32(&standIn.accepted); accepted != 2 {
+		t.Errorf("the queries took %d connections, want 2", accepted)
+	}
+}
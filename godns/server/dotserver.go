@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	. "godns/config"
+	"net"
+	"time"
+)
+
+const defaultDoTIdleTimeout = 30 * time.Second
+
+var stopCertificateWatch context.CancelFunc = func() {}
+
+// serverTLSConfig is used by the DoH and DoT listeners for their whole life and
+// always hands out the current certificate, so a reload that changes it does
+// not need to rebind them.
+var serverTLSConfig = &tls.Config{
+	GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certificates := getServerState().certificates
+		if certificates == nil {
+			return nil, errors.New("no certificate is configured")
+		}
+		return certificates.GetCertificate(hello)
+	},
+	MinVersion: tls.VersionTLS12,
+}
+
+// loadServerCertificates loads the certificate of the config. It returns nil
+// without an error when no certificate is configured. The returned function
+// stops watching the files for changes.
+func loadServerCertificates(config *ConfigInstance, mainContext context.Context) (*CertificateHandler, context.CancelFunc, error) {
+	if config.TLSCertFile == "" && config.TLSKeyFile == "" {
+		return nil, func() {}, nil
+	}
+
+	watchContext, stop := context.WithCancel(mainContext)
+	certificates, err := NewCertificateHandler(config.TLSCertFile, config.TLSKeyFile, config.UpdateLivetime, watchContext)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	return certificates, stop, nil
+}
+
+// listenDoT opens the DNS-over-TLS listener (RFC 7858). It returns nil without
+// an error when dot-port is not configured. The TLS handshake happens on the
+// accepted connections, see serveTCPConnections.
+func listenDoT(config *ConfigInstance) (*net.TCPListener, error) {
+	if config.DoTPort == 0 {
+		return nil, nil
+	}
+	if getServerState().certificates == nil {
+		return nil, errors.New("tls-cert and tls-key are required for DNS-over-TLS")
+	}
+	var tcpAddr = &net.TCPAddr{
+		IP:   net.ParseIP(config.Host),
+		Port: config.DoTPort,
+	}
+	return net.ListenTCP("tcp", tcpAddr)
+}
+
+func getDoTIdleTimeout(config *ConfigInstance) time.Duration {
+	idleTimeout := config.DoTIdleTimeout * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = defaultDoTIdleTimeout
+	}
+	return idleTimeout
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	. "godns/config"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	defaultUDPPayloadSize = 1232
+	minUDPPayloadSize     = 512
+	maxTCPMessageSize     = 65535
+
+	ednsDOBit                                     = 1 << 15
+	dnsResponseCodeBadVers layers.DNSResponseCode = 16
+)
+
+// ednsOptions describes the OPT pseudo-record of a message (RFC 6891).
+type ednsOptions struct {
+	present bool
+	udpSize uint16
+	version uint8
+	do      bool
+}
+
+func getEDNSOptions(dnsMessage layers.DNS) ednsOptions {
+	for _, rr := range dnsMessage.Additionals {
+		if rr.Type == layers.DNSTypeOPT {
+			return ednsOptions{
+				present: true,
+				udpSize: uint16(rr.Class),
+				version: uint8(rr.TTL >> 16),
+				do:      rr.TTL&ednsDOBit != 0,
+			}
+		}
+	}
+	return ednsOptions{}
+}
+
+func getUDPPayloadSize(config *ConfigInstance) uint16 {
+	if config.UDPPayloadSize < minUDPPayloadSize {
+		return defaultUDPPayloadSize
+	}
+	return config.UDPPayloadSize
+}
+
+// getClientUDPSize returns how large a UDP response to this client may be:
+// 512 bytes without EDNS, otherwise the advertised size limited by our own.
+func getClientUDPSize(config *ConfigInstance, dnsIntReq layers.DNS) int {
+	edns := getEDNSOptions(dnsIntReq)
+	if !edns.present || edns.udpSize < minUDPPayloadSize {
+		return minUDPPayloadSize
+	}
+	if edns.udpSize > getUDPPayloadSize(config) {
+		return int(getUDPPayloadSize(config))
+	}
+	return int(edns.udpSize)
+}
+
+// getOPTRecord builds an OPT pseudo-record. The upper eight bits of an
+// extended response code travel in the TTL field, next to the version and
+// the DO bit.
+func getOPTRecord(payloadSize uint16, rcode layers.DNSResponseCode, do bool) layers.DNSResourceRecord {
+	ttl := uint32(rcode>>4) << 24
+	if do {
+		ttl |= ednsDOBit
+	}
+	return layers.DNSResourceRecord{
+		Type:  layers.DNSTypeOPT,
+		Class: layers.DNSClass(payloadSize),
+		TTL:   ttl,
+	}
+}
+
+func withoutOPT(records []layers.DNSResourceRecord) []layers.DNSResourceRecord {
+	var filtered []layers.DNSResourceRecord
+	for _, rr := range records {
+		if rr.Type != layers.DNSTypeOPT {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+// getUpstreamRequest replaces the client's OPT record with our own, so that
+// upstream servers see our payload size. The DO bit is always set: the answer
+// is cached for clients with and without DO alike, and getClientResponse
+// removes the signatures for those who did not ask for them. The ID of the
+// client is replaced as well; the answer gets it back in refreshDNSPacket.
+func getUpstreamRequest(config *ConfigInstance, dnsIntReq layers.DNS) layers.DNS {
+	newDNSReq := dnsIntReq
+	newDNSReq.ID = getRandomID()
+	newDNSReq.Additionals = append(withoutOPT(dnsIntReq.Additionals),
+		getOPTRecord(getUDPPayloadSize(config), 0, true))
+	return getRebuiltDNSPacket(newDNSReq)
+}
+
+// getPlainRequest drops the OPT record for upstream servers that answer
+// EDNS queries with FORMERR.
+func getPlainRequest(dnsIntReq layers.DNS) layers.DNS {
+	newDNSReq := dnsIntReq
+	newDNSReq.Additionals = withoutOPT(dnsIntReq.Additionals)
+	return getRebuiltDNSPacket(newDNSReq)
+}
+
+// getClientResponse serializes a response for the client that sent dnsIntReq.
+// The upstream OPT record is replaced with ours when the client speaks EDNS,
+// DNSSEC records are removed unless the client set DO, and the message is
+// truncated with the TC bit set if it does not fit into maxSize bytes.
+func getClientResponse(config *ConfigInstance, dnsIntReq layers.DNS, dnsResponse layers.DNS, maxSize int) []byte {
+	edns := getEDNSOptions(dnsIntReq)
+
+	dnsResponse.Additionals = withoutOPT(dnsResponse.Additionals)
+	if !edns.do && (len(dnsIntReq.Questions) == 0 || !isDNSSECType(dnsIntReq.Questions[0].Type)) {
+		dnsResponse.Answers = withoutDNSSECRecords(dnsResponse.Answers)
+		dnsResponse.Authorities = withoutDNSSECRecords(dnsResponse.Authorities)
+		dnsResponse.Additionals = withoutDNSSECRecords(dnsResponse.Additionals)
+	}
+
+	if edns.present {
+		dnsResponse.Additionals = append(dnsResponse.Additionals,
+			getOPTRecord(getUDPPayloadSize(config), dnsResponse.ResponseCode, edns.do))
+	} else if dnsResponse.ResponseCode > 0xF {
+		dnsResponse.ResponseCode = layers.DNSResponseCodeServFail
+	}
+
+	data := packDNSMessage(dnsResponse)
+	if len(data) <= maxSize {
+		return data
+	}
+
+	dnsResponse.TC = true
+	dnsResponse.Answers = nil
+	dnsResponse.Authorities = nil
+	if edns.present {
+		dnsResponse.Additionals = dnsResponse.Additionals[len(dnsResponse.Additionals)-1:]
+	} else {
+		dnsResponse.Additionals = nil
+	}
+	return packDNSMessage(dnsResponse)
+}
+
+func isDNSSECType(recordType layers.DNSType) bool {
+	switch recordType {
+	case dnsTypeRRSIG, dnsTypeNSEC, dnsTypeNSEC3:
+		return true
+	}
+	return false
+}
+
+func withoutDNSSECRecords(records []layers.DNSResourceRecord) []layers.DNSResourceRecord {
+	var filtered []layers.DNSResourceRecord
+	for _, rr := range records {
+		if !isDNSSECType(rr.Type) {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
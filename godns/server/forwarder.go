@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	. "godns/config"
+	. "godns/logger"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	forwardMode = "forward"
+
+	strategySequential    = "sequential"
+	strategyRandom        = "random"
+	strategyRoundRobin    = "round-robin"
+	strategyLowestLatency = "lowest-latency"
+
+	defaultMaxFails = 3
+	defaultCooldown = 30 * time.Second
+
+	// upstreamFailRTT is charged to the latency estimate of an upstream that
+	// did not answer, the same as the UDP read deadline.
+	upstreamFailRTT = time.Second / 2
+
+	protocolUDP = "udp"
+	protocolTCP = "tcp"
+	protocolTLS = "tls"
+)
+
+// upstream keeps the health state of one forwarding target.
+type upstream struct {
+	address   string
+	protocol  string
+	dot       *dotPool
+	fails     int
+	downUntil time.Time
+	srtt      time.Duration
+}
+
+type forwarder struct {
+	mu        sync.Mutex
+	strategy  string
+	maxFails  int
+	cooldown  time.Duration
+	upstreams []*upstream
+	next      int
+}
+
+func isForwardMode(config *ConfigInstance) bool {
+	return config.Mode == forwardMode
+}
+
+// newForwarder sets up the upstreams of config. Unknown strategies and
+// protocols are an error rather than a fallback, so a typo can't send queries
+// meant for TLS in plain text.
+func newForwarder(config ForwardConfig) (*forwarder, error) {
+	switch config.Strategy {
+	case "", strategySequential, strategyRandom, strategyRoundRobin, strategyLowestLatency:
+	default:
+		return nil, fmt.Errorf("unknown strategy %s", config.Strategy)
+	}
+	for _, upstreamConf := range config.Upstreams {
+		switch upstreamConf.Protocol {
+		case "", protocolUDP, protocolTCP, protocolTLS:
+		default:
+			return nil, fmt.Errorf("unknown protocol %s for upstream %s", upstreamConf.Protocol, upstreamConf.Address)
+		}
+	}
+
+	fwd := &forwarder{
+		strategy: config.Strategy,
+		maxFails: config.MaxFails,
+		cooldown: config.Cooldown * time.Second,
+	}
+	if fwd.strategy == "" {
+		fwd.strategy = strategySequential
+	}
+	if fwd.maxFails <= 0 {
+		fwd.maxFails = defaultMaxFails
+	}
+	if fwd.cooldown <= 0 {
+		fwd.cooldown = defaultCooldown
+	}
+	for _, upstreamConf := range config.Upstreams {
+		u := &upstream{address: upstreamConf.Address, protocol: upstreamConf.Protocol}
+		if u.protocol == protocolTLS {
+			pool, err := newDoTPool(upstreamConf)
+			if err != nil {
+				fwd.close()
+				return nil, err
+			}
+			u.dot = pool
+		}
+		fwd.upstreams = append(fwd.upstreams, u)
+	}
+	return fwd, nil
+}
+
+// close drops the pooled connections of the upstreams.
+func (fwd *forwarder) close() {
+	for _, u := range fwd.upstreams {
+		if u.dot != nil {
+			u.dot.close()
+		}
+	}
+}
+
+// exchange sends the query to the upstream over its configured transport.
+func (u *upstream) exchange(tap *dnstapTap, dnsIntReq layers.DNS) layers.DNS {
+	switch u.protocol {
+	case protocolTCP:
+		return resendOverTCPWait4Response(tap, u.address, dnsIntReq)
+	case protocolTLS:
+		return u.dot.exchange(tap, dnsIntReq)
+	}
+	return resendToExternalWait4Response(tap, u.address, dnsIntReq)
+}
+
+// candidates returns the upstreams in the order they should be tried. Healthy
+// upstreams come first in the order of the configured strategy, upstreams on
+// cooldown follow as a last resort, the ones that recover soonest first.
+func (fwd *forwarder) candidates() []*upstream {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+
+	now := time.Now()
+	var healthy, down []*upstream
+	for _, u := range fwd.upstreams {
+		if now.Before(u.downUntil) {
+			down = append(down, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+
+	switch fwd.strategy {
+	case strategyRandom:
+		rand.Shuffle(len(healthy), func(i, j int) {
+			healthy[i], healthy[j] = healthy[j], healthy[i]
+		})
+	case strategyRoundRobin:
+		if len(healthy) > 0 {
+			start := fwd.next % len(healthy)
+			healthy = append(healthy[start:], healthy[:start]...)
+			fwd.next++
+		}
+	case strategyLowestLatency:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].srtt < healthy[j].srtt
+		})
+	}
+	sort.SliceStable(down, func(i, j int) bool {
+		return down[i].downUntil.Before(down[j].downUntil)
+	})
+	return append(healthy, down...)
+}
+
+// report updates the health of an upstream after a query. The latency estimate
+// is a moving average as in RFC 6298, and after maxFails failures in a row the
+// upstream is put on cooldown.
+func (fwd *forwarder) report(u *upstream, rtt time.Duration, ok bool) {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+
+	if !ok {
+		rtt = upstreamFailRTT
+	}
+	if u.srtt == 0 {
+		u.srtt = rtt
+	} else {
+		u.srtt = (7*u.srtt + rtt) / 8
+	}
+
+	if ok {
+		u.fails = 0
+		u.downUntil = time.Time{}
+		return
+	}
+
+	u.fails++
+	if u.fails >= fwd.maxFails {
+		u.fails = 0
+		u.downUntil = time.Now().Add(fwd.cooldown)
+		Warnf("Upstream %s is not responding, cooling down for %s", u.address, fwd.cooldown)
+	}
+}
+
+// forwardDNSPacket sends the question to the upstream resolvers of fwd until
+// one of them gives a usable answer. SERVFAIL and REFUSED count as failures,
+// and the last of them is returned if no upstream does better.
+func forwardDNSPacket(state *serverState, fwd *forwarder, dnsIntReq layers.DNS, trace *queryTrace) (layers.DNS, bool) {
+	dnsIntReq.RD = true
+	dnsIntReq = getRebuiltDNSPacket(dnsIntReq)
+
+	var lastResponse layers.DNS
+	var answered bool
+
+	for _, u := range fwd.candidates() {
+		started := time.Now()
+		trace.addUpstream(u.address)
+		query := withNewID(dnsIntReq)
+		dnsResponse := u.exchange(state.tap, query)
+		countUpstreamQuery(u.address, time.Since(started), len(dnsResponse.Contents) > 0)
+
+		if len(dnsResponse.Contents) == 0 || dnsResponse.ID != query.ID {
+			fwd.report(u, 0, false)
+			continue
+		}
+
+		switch dnsResponse.ResponseCode {
+		case layers.DNSResponseCodeServFail, layers.DNSResponseCodeRefused:
+			fwd.report(u, 0, false)
+			lastResponse, answered = dnsResponse, true
+			continue
+		}
+
+		fwd.report(u, time.Since(started), true)
+		return dnsResponse, true
+	}
+	return lastResponse, answered
+}
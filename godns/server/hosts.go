@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	. "godns/config"
+	. "godns/logger"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+)
+
+// hostsTTL is the TTL given to answers from the host overrides.
+const hostsTTL = 60
+
+// hostsTable holds the static host overrides of the config and of the hosts
+// files, together with the reverse names of their addresses.
+type hostsTable struct {
+	mu        sync.RWMutex
+	addresses map[string][]net.IP
+	names     map[string][]string
+	stopWatch context.CancelFunc
+}
+
+var staticHosts = &hostsTable{stopWatch: func() {}}
+
+// load reads the hosts files and the hosts map of the config. An entry of the
+// map replaces the addresses the files have for the same name. With
+// update-in-livetime on, the table is built again when a hosts file changes.
+func (ht *hostsTable) load(handler *ConfigHandler, mainContext context.Context) {
+	config := handler.Get()
+	ht.build(config)
+
+	watchContext, stop := context.WithCancel(mainContext)
+	ht.mu.Lock()
+	ht.stopWatch()
+	ht.stopWatch = stop
+	ht.mu.Unlock()
+
+	if !config.UpdateLivetime {
+		return
+	}
+	for _, path := range config.HostsFiles {
+		go WatchFile(path, watchContext, func() {
+			ht.build(config)
+			Infof("Hosts file was changed")
+		})
+	}
+}
+
+func (ht *hostsTable) build(config *ConfigInstance) {
+	addresses := make(map[string][]net.IP)
+	for _, path := range config.HostsFiles {
+		entries, err := readHostsFile(path)
+		if err != nil {
+			Errorf("Can't read hosts file %s: %v", path, err)
+			continue
+		}
+		for name, ips := range entries {
+			addresses[name] = append(addresses[name], ips...)
+		}
+	}
+
+	for name, value := range config.Hosts {
+		var ips []net.IP
+		for _, field := range strings.Fields(value) {
+			if ip := net.ParseIP(field); ip != nil {
+				ips = append(ips, ip)
+			} else {
+				Warnf("Invalid address %s for host %s", field, name)
+			}
+		}
+		addresses[canonicalName(name)] = ips
+	}
+
+	names := make(map[string][]string)
+	for name, ips := range addresses {
+		for _, ip := range ips {
+			reverse := getReverseName(ip)
+			names[reverse] = append(names[reverse], name)
+		}
+	}
+	for _, hostnames := range names {
+		sort.Strings(hostnames)
+	}
+
+	ht.mu.Lock()
+	ht.addresses = addresses
+	ht.names = names
+	ht.mu.Unlock()
+}
+
+// readHostsFile returns the addresses listed for each name in a file of the
+// /etc/hosts format.
+func readHostsFile(path string) (map[string][]net.IP, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// Zone indexes like fe80::1%eth0 have no meaning in DNS answers.
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = canonicalName(name)
+			entries[name] = append(entries[name], ip)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// getHostsResponse answers A, AAAA and PTR questions for the host overrides.
+// A name that has only addresses of the other family gets an empty answer, so
+// that the real records do not bypass the override. The second result is
+// false when the overrides know nothing about the question.
+func getHostsResponse(dnsIntReq layers.DNS) (layers.DNS, bool) {
+	question := dnsIntReq.Questions[0]
+	if question.Class != layers.DNSClassIN {
+		return layers.DNS{}, false
+	}
+	name := canonicalName(string(question.Name))
+
+	staticHosts.mu.RLock()
+	defer staticHosts.mu.RUnlock()
+
+	var answers []layers.DNSResourceRecord
+	switch question.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		ips, found := staticHosts.addresses[name]
+		if !found {
+			return layers.DNS{}, false
+		}
+		for _, ip := range ips {
+			rrType := layers.DNSTypeAAAA
+			if ip.To4() != nil {
+				rrType = layers.DNSTypeA
+				ip = ip.To4()
+			}
+			if rrType == question.Type {
+				answers = append(answers, layers.DNSResourceRecord{
+					Name:  question.Name,
+					Type:  rrType,
+					Class: layers.DNSClassIN,
+					TTL:   hostsTTL,
+					IP:    ip,
+				})
+			}
+		}
+
+	case layers.DNSTypePTR:
+		hostnames, found := staticHosts.names[name]
+		if !found {
+			return layers.DNS{}, false
+		}
+		for _, hostname := range hostnames {
+			answers = append(answers, layers.DNSResourceRecord{
+				Name:  question.Name,
+				Type:  layers.DNSTypePTR,
+				Class: layers.DNSClassIN,
+				TTL:   hostsTTL,
+				PTR:   []byte(hostname),
+			})
+		}
+
+	default:
+		return layers.DNS{}, false
+	}
+
+	dnsResponse := getErrorResponse(dnsIntReq, layers.DNSResponseCodeNoErr)
+	dnsResponse.AA = true
+	dnsResponse.Answers = answers
+	return dnsResponse, true
+}
+
+// getReverseName returns the in-addr.arpa or ip6.arpa name of an address.
+func getReverseName(ip net.IP) string {
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip4[i])))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa"
+	}
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		labels = append(labels, strconv.FormatUint(uint64(ip16[i]&0xf), 16), strconv.FormatUint(uint64(ip16[i]>>4), 16))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	"io"
+	"net"
+	"strconv"
+)
+
+// servedListener is a listener in service at address until it is closed.
+type servedListener struct {
+	listenerKind
+	sockets []io.Closer
+	stop    context.CancelFunc
+}
+
+// close stops serving and closes the sockets at once, so their address can be
+// bound again right away.
+func (sl *servedListener) close() {
+	sl.stop()
+	for _, socket := range sl.sockets {
+		socket.Close()
+	}
+}
+
+// listenerKind is one of the listeners the config asks for, with the address
+// it should be at, empty when it is off. open binds its sockets and returns
+// the function that starts serving them.
+type listenerKind struct {
+	name    string
+	address string
+	open    func() (func(ctx context.Context), []io.Closer, error)
+}
+
+// listeners are the listeners in service by name. They outlive reloads that
+// leave their address alone.
+var listeners = make(map[string]*servedListener)
+
+func getListenerKinds(handler *ConfigHandler, config *ConfigInstance, cache *Cache) []listenerKind {
+	return []listenerKind{
+		{"DNS", getListenerAddress(config.Host, 53), func() (func(context.Context), []io.Closer, error) {
+			conn, err := listenUDP(config)
+			if err != nil {
+				return nil, nil, err
+			}
+			tcpListener, err := listenTCP(config)
+			if err != nil {
+				conn.Close()
+				return nil, nil, err
+			}
+			return func(ctx context.Context) {
+				go serveRequest(handler, ctx, conn, cache)
+				go serveTCPConnections(handler, ctx, tcpListener, nil, getTCPIdleTimeout, cache)
+			}, []io.Closer{conn, tcpListener}, nil
+		}},
+		{"DNS-over-HTTPS", getListenerAddress(config.Host, config.DoHPort), func() (func(context.Context), []io.Closer, error) {
+			listener, err := listenDoH(config)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func(ctx context.Context) {
+				go serveDoH(handler, ctx, listener, cache)
+			}, []io.Closer{listener}, nil
+		}},
+		{"DNS-over-TLS", getListenerAddress(config.Host, config.DoTPort), func() (func(context.Context), []io.Closer, error) {
+			listener, err := listenDoT(config)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func(ctx context.Context) {
+				go serveTCPConnections(handler, ctx, listener, serverTLSConfig, getDoTIdleTimeout, cache)
+			}, []io.Closer{listener}, nil
+		}},
+		{"Metrics", getListenerAddress(config.Host, config.MetricsPort), func() (func(context.Context), []io.Closer, error) {
+			listener, err := listenMetrics(config)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func(ctx context.Context) {
+				go serveMetrics(ctx, listener)
+			}, []io.Closer{listener}, nil
+		}},
+	}
+}
+
+func getListenerAddress(host string, port int) string {
+	if port == 0 {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// updateListeners brings the listeners in line with the config. Those whose
+// address is unchanged keep serving, the others are moved, opened or closed.
+// The last failure, if any, is returned once all listeners were tried.
+func updateListeners(handler *ConfigHandler, mainContext context.Context, cache *Cache) error {
+	var failed error
+	for _, kind := range getListenerKinds(handler, handler.Get(), cache) {
+		current := listeners[kind.name]
+		if current == nil && kind.address == "" || current != nil && current.address == kind.address {
+			continue
+		}
+		if kind.address == "" {
+			current.close()
+			delete(listeners, kind.name)
+			Infof("%s listener on %s was closed", kind.name, current.address)
+			continue
+		}
+
+		if current != nil {
+			err := current.move(mainContext, kind)
+			if err != nil {
+				Errorf("Can't move %s listener to %s, keeping it on %s: %v", kind.name, kind.address, current.address, err)
+				failed = err
+			}
+			continue
+		}
+
+		if err := startListener(mainContext, kind); err != nil {
+			Errorf("Can't start %s listener on %s: %v", kind.name, kind.address, err)
+			failed = err
+		}
+	}
+	return failed
+}
+
+func startListener(mainContext context.Context, kind listenerKind) error {
+	serve, sockets, err := kind.open()
+	if err != nil {
+		return err
+	}
+	listenContext, stop := context.WithCancel(mainContext)
+	listeners[kind.name] = &servedListener{listenerKind: kind, sockets: sockets, stop: stop}
+	serve(listenContext)
+	Infof("%s listener is up on %s", kind.name, kind.address)
+	return nil
+}
+
+// move replaces the listener with one at the address of kind. The new
+// address is bound while the old socket is still open, so no query is
+// missed; only when that fails, because the addresses overlap, the old socket
+// is closed first. If the new address can't be bound at all, the old one is
+// bound again.
+func (sl *servedListener) move(mainContext context.Context, kind listenerKind) error {
+	serve, sockets, err := kind.open()
+	if err == nil {
+		sl.close()
+		listenContext, stop := context.WithCancel(mainContext)
+		listeners[kind.name] = &servedListener{listenerKind: kind, sockets: sockets, stop: stop}
+		serve(listenContext)
+		Infof("%s listener moved to %s", kind.name, kind.address)
+		return nil
+	}
+
+	sl.close()
+	delete(listeners, kind.name)
+	if err = startListener(mainContext, kind); err == nil {
+		return nil
+	}
+	if restoreErr := startListener(mainContext, sl.listenerKind); restoreErr != nil {
+		Errorf("Can't bind %s listener on %s again: %v", sl.name, sl.address, restoreErr)
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	. "godns/metrics"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	metricsPath = "/metrics"
+
+	transportUDP = "udp"
+	transportTCP = "tcp"
+	transportDoT = "dot"
+	transportDoH = "doh"
+)
+
+var (
+	queriesTotal = NewCounterVec("godns_queries_total",
+		"DNS queries received, by query type and client transport.", "qtype", "transport")
+	responsesTotal = NewCounterVec("godns_responses_total",
+		"DNS responses sent, by response code.", "rcode")
+	inflightQueries = NewGauge("godns_inflight_queries",
+		"Queries being resolved right now, each in its own goroutine.")
+	upstreamDuration = NewHistogramVec("godns_upstream_query_duration_seconds",
+		"Time until an upstream, root or authoritative server answered.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}, "server")
+	upstreamTimeouts = NewCounterVec("godns_upstream_timeouts_total",
+		"Queries to an upstream, root or authoritative server that got no answer.", "server")
+	resolutionDepth = NewHistogramVec("godns_resolution_depth",
+		"Referrals followed by each iterative resolution.",
+		[]float64{0, 1, 2, 3, 4, 6, 8, 12, 16})
+	blocklistHits = NewCounterVec("godns_blocklist_hits_total",
+		"Queries decided by a blocklist, allowed ones included.", "list")
+	rateLimited = NewCounterVec("godns_rate_limited_total",
+		"Queries and responses over a rate limit, by limit and what was done with them.", "limit", "action")
+	prefetchesTotal = NewCounterVec("godns_prefetches_total",
+		"Popular cache entries refreshed before they expired, by result.", "result")
+	staleAnswersTotal = NewCounterVec("godns_stale_answers_total",
+		"Queries answered from expired cache entries, by why no fresh answer was given.", "reason")
+)
+
+func init() {
+	NewGaugeFunc("godns_goroutines", "Goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	NewCounterFunc("godns_cache_hits_total", "Cache lookups that found a live entry.", func() float64 {
+		return float64(getCacheStats().Hits)
+	})
+	NewCounterFunc("godns_cache_misses_total", "Cache lookups that found nothing or an expired entry.", func() float64 {
+		return float64(getCacheStats().Misses)
+	})
+	NewCounterFunc("godns_cache_evictions_total", "Cache entries removed to stay within the cache limits.", func() float64 {
+		return float64(getCacheStats().Evictions)
+	})
+	NewCounterFunc("godns_cache_expirations_total", "Expired cache entries removed by the cleanup.", func() float64 {
+		return float64(getCacheStats().Expirations)
+	})
+	NewGaugeFunc("godns_cache_entries", "Entries in the cache.", func() float64 {
+		return float64(getCacheStats().Size)
+	})
+	NewGaugeFunc("godns_cache_bytes", "Approximate memory taken by the cache entries.", func() float64 {
+		return float64(getCacheStats().Bytes)
+	})
+}
+
+func getCacheStats() CacheStats {
+	cache := getServerState().cache
+	if cache == nil {
+		return CacheStats{}
+	}
+	return cache.Stats()
+}
+
+// Names of the types gopacket has no String for.
+var extraTypeNames = map[layers.DNSType]string{
+	dnsTypeDS:     "DS",
+	dnsTypeRRSIG:  "RRSIG",
+	dnsTypeNSEC:   "NSEC",
+	dnsTypeDNSKEY: "DNSKEY",
+	dnsTypeNSEC3:  "NSEC3",
+	dnsTypeIXFR:   "IXFR",
+	dnsTypeAXFR:   "AXFR",
+	dnsTypeANY:    "ANY",
+}
+
+var responseCodeNames = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+	dnsResponseCodeBadVers:         "BADVERS",
+}
+
+func getTypeName(qtype layers.DNSType) string {
+	if name, found := extraTypeNames[qtype]; found {
+		return name
+	}
+	if name := qtype.String(); name != "Unknown" {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+func getResponseCodeName(rcode layers.DNSResponseCode) string {
+	if name, found := responseCodeNames[rcode]; found {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
+
+// countQuery records a served query and the response it got.
+func countQuery(dnsIntReq layers.DNS, transport string, dnsResponse layers.DNS) {
+	qtype := "NONE"
+	if len(dnsIntReq.Questions) > 0 {
+		qtype = getTypeName(dnsIntReq.Questions[0].Type)
+	}
+	queriesTotal.Inc(qtype, transport)
+	responsesTotal.Inc(getResponseCodeName(dnsResponse.ResponseCode))
+}
+
+// authoritativeServer is the server label of all servers met while resolving
+// that are not root servers. They are not told apart, so the number of series
+// stays bounded however many of them the resolution meets.
+const authoritativeServer = "authoritative"
+
+// countUpstreamQuery records the outcome of one query to another server.
+// Configured upstreams and root servers are labelled by address, see
+// getServerLabel for the others.
+func countUpstreamQuery(server string, rtt time.Duration, answered bool) {
+	if answered {
+		upstreamDuration.Observe(rtt.Seconds(), server)
+	} else {
+		upstreamTimeouts.Inc(server)
+	}
+}
+
+// getServerLabel labels a server the iterative resolution queried: a root
+// server by its address, any other server as authoritative.
+func getServerLabel(address string) string {
+	if rootServers.isRoot(address) {
+		return address
+	}
+	return authoritativeServer
+}
+
+// countRateLimited records a query or response that went over its limit.
+func countRateLimited(limit string, action rateAction) {
+	if action != rateAllow {
+		rateLimited.Inc(limit, rateActionNames[action])
+	}
+}
+
+func listenMetrics(config *ConfigInstance) (net.Listener, error) {
+	if config.MetricsPort == 0 {
+		return nil, nil
+	}
+	return net.Listen("tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.MetricsPort)))
+}
+
+// serveMetrics exposes the metrics over plain HTTP for Prometheus to scrape,
+// until listenContext is done.
+func serveMetrics(listenContext context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, Handler())
+	httpServer := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  time.Second * 5,
+		WriteTimeout: time.Second * 5,
+	}
+
+	go func() {
+		<-listenContext.Done()
+		httpServer.Close()
+	}()
+
+	err := httpServer.Serve(listener)
+	if err != nil && err != http.ErrServerClosed && listenContext.Err() == nil {
+		Errorf("Metrics listener stopped: %v", err)
+	}
+}
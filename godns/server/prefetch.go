@@ -0,0 +1,100 @@
+package server
+
+import (
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	defaultPrefetchPercent     = 10
+	defaultPrefetchConcurrency = 4
+)
+
+// prefetcher refreshes popular cache entries in the background when they are
+// about to expire, so their clients keep getting answers from the cache. An
+// entry is popular once it was read min-hits times since it was cached.
+type prefetcher struct {
+	minHits uint64
+	percent int64
+	minTTL  time.Duration
+	slots   chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func newPrefetcher(prefetchConf PrefetchConfig) *prefetcher {
+	if prefetchConf.MinHits == 0 {
+		return &prefetcher{}
+	}
+	percent := prefetchConf.TTLPercent
+	if percent <= 0 || percent >= 100 {
+		percent = defaultPrefetchPercent
+	}
+	concurrency := prefetchConf.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+	return &prefetcher{
+		minHits: prefetchConf.MinHits,
+		percent: int64(percent),
+		minTTL:  prefetchConf.MinTTL * time.Second,
+		slots:   make(chan struct{}, concurrency),
+		pending: make(map[string]bool),
+	}
+}
+
+// check starts refreshing the entry just read from the cache if it is popular
+// and in the last ttl-percent of its life. When all slots are busy the entry
+// is skipped, its next hit tries again.
+func (pf *prefetcher) check(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, cacheKey []byte, item CacheItem) {
+	if pf.slots == nil || item.Hits < pf.minHits {
+		return
+	}
+	total, left := item.Lifetime(time.Now())
+	if total < pf.minTTL || left <= 0 || left*100 > total*time.Duration(pf.percent) {
+		return
+	}
+
+	key := string(cacheKey)
+	pf.mu.Lock()
+	if pf.pending[key] {
+		pf.mu.Unlock()
+		return
+	}
+	select {
+	case pf.slots <- struct{}{}:
+	default:
+		pf.mu.Unlock()
+		return
+	}
+	pf.pending[key] = true
+	pf.mu.Unlock()
+
+	state.hold()
+	go pf.refresh(handler, state, dnsIntReq, cache, cacheKey)
+}
+
+func (pf *prefetcher) refresh(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, cacheKey []byte) {
+	defer func() {
+		pf.mu.Lock()
+		delete(pf.pending, string(cacheKey))
+		pf.mu.Unlock()
+		<-pf.slots
+		state.release()
+	}()
+
+	question := dnsIntReq.Questions[0]
+	Debugf("Prefetching %s %s", string(question.Name), getTypeName(question.Type))
+	if _, ok := refreshDNSPacket(handler, state, dnsIntReq, cache, cacheKey, &queryTrace{}); !ok {
+		Debugf("Prefetching %s %s failed", string(question.Name), getTypeName(question.Type))
+		prefetchesTotal.Inc("failed")
+		return
+	}
+	prefetchesTotal.Inc("ok")
+}
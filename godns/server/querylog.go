@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	. "godns/config"
+	. "godns/logger"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// queryTrace collects what happened while a client query was answered, for the
+// query log. Its methods do nothing on a nil trace, which is what the lookups
+// the server makes on its own behalf pass.
+type queryTrace struct {
+	cacheHit  bool
+	stale     bool
+	upstreams []string
+}
+
+func (trace *queryTrace) setCacheHit() {
+	if trace != nil {
+		trace.cacheHit = true
+	}
+}
+
+func (trace *queryTrace) setStale() {
+	if trace != nil {
+		trace.stale = true
+	}
+}
+
+// addUpstream records a server the query was sent to, once per address.
+func (trace *queryTrace) addUpstream(address string) {
+	if trace == nil {
+		return
+	}
+	for _, known := range trace.upstreams {
+		if known == address {
+			return
+		}
+	}
+	trace.upstreams = append(trace.upstreams, address)
+}
+
+// queryLogEntry is one line of the query log.
+type queryLogEntry struct {
+	Time      string   `json:"time"`
+	Client    string   `json:"client"`
+	Transport string   `json:"transport"`
+	Name      string   `json:"qname"`
+	Type      string   `json:"qtype"`
+	Rcode     string   `json:"rcode"`
+	Answers   int      `json:"answers"`
+	CacheHit  bool     `json:"cache_hit"`
+	Stale     bool     `json:"stale"`
+	Upstreams []string `json:"upstreams"`
+	LatencyMs float64  `json:"latency_ms"`
+}
+
+func openQueryLog(config *ConfigInstance) (*RotatingFile, error) {
+	if config.QueryLog.File == "" {
+		return nil, nil
+	}
+	return OpenRotatingFile(config.QueryLog.File, config.QueryLog.MaxSize*1024*1024,
+		config.QueryLog.RotateEvery*time.Second, config.QueryLog.MaxBackups)
+}
+
+// logQuery writes a line about a served query to logFile, the query log of
+// the query's state. Nothing is written when logging is off.
+func logQuery(logFile *RotatingFile, dnsIntReq layers.DNS, transport string, client string, dnsResponse layers.DNS, trace *queryTrace, latency time.Duration) {
+	if logFile == nil {
+		return
+	}
+
+	entry := queryLogEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Client:    client,
+		Transport: transport,
+		Rcode:     getResponseCodeName(dnsResponse.ResponseCode),
+		Answers:   len(dnsResponse.Answers),
+		CacheHit:  trace.cacheHit,
+		Stale:     trace.stale,
+		Upstreams: trace.upstreams,
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+	}
+	if entry.Upstreams == nil {
+		entry.Upstreams = []string{}
+	}
+	if len(dnsIntReq.Questions) > 0 {
+		entry.Name = canonicalName(string(dnsIntReq.Questions[0].Name)) + "."
+		entry.Type = getTypeName(dnsIntReq.Questions[0].Type)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if _, err := logFile.Write(append(line, '\n')); err != nil {
+		Errorf("Can't write to the query log: %v", err)
+	}
+}
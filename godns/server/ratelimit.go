@@ -0,0 +1,243 @@
+package server
+
+import (
+	. "godns/config"
+	. "godns/logger"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	defaultIPv4Prefix = 24
+	defaultIPv6Prefix = 56
+
+	rateLimitSweepInterval = time.Second * 10
+)
+
+// rateAction is what happens to a query or response.
+type rateAction int
+
+const (
+	rateAllow rateAction = iota
+	rateDrop
+	rateSlip
+	rateRefuse
+)
+
+var rateActionNames = map[rateAction]string{
+	rateDrop:   "drop",
+	rateSlip:   "slip",
+	rateRefuse: "refuse",
+}
+
+// tokenBucket holds up to burst tokens, refilled at a steady rate; every
+// message takes one. A bucket that ran dry is limited until it fills up again,
+// which keeps the logs quiet while a client hovers around the limit.
+type tokenBucket struct {
+	tokens    float64
+	updated   time.Time
+	limited   bool
+	overLimit int
+}
+
+// rateTable is a set of token buckets sharing the same rate.
+type rateTable struct {
+	name  string
+	rate  float64
+	burst float64
+	slip  int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newRateTable(name string, rate int, burst int, slip int) *rateTable {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = rate
+	}
+	return &rateTable{
+		name:    name,
+		rate:    float64(rate),
+		burst:   float64(burst),
+		slip:    slip,
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// take spends a token from the bucket of key. Messages over the limit are
+// dropped, except that every slip-th one is let through truncated.
+func (table *rateTable) take(key string) rateAction {
+	now := time.Now()
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.sweep(now)
+
+	bucket, found := table.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: table.burst, updated: now}
+		table.buckets[key] = bucket
+	}
+	table.refill(bucket, now)
+
+	if bucket.tokens >= 1 {
+		if bucket.limited && bucket.tokens >= table.burst {
+			table.logRecovery(key, bucket)
+		}
+		bucket.tokens--
+		return rateAllow
+	}
+
+	bucket.overLimit++
+	if !bucket.limited {
+		bucket.limited = true
+		Warnf("Rate limiting %s: %s", table.name, key)
+	}
+	if table.slip > 0 && bucket.overLimit%table.slip == 0 {
+		return rateSlip
+	}
+	return rateDrop
+}
+
+func (table *rateTable) refill(bucket *tokenBucket, now time.Time) {
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * table.rate
+	if bucket.tokens > table.burst {
+		bucket.tokens = table.burst
+	}
+	bucket.updated = now
+}
+
+// sweep forgets the buckets that are full again, so clients that went quiet
+// do not pile up.
+func (table *rateTable) sweep(now time.Time) {
+	if now.Sub(table.swept) < rateLimitSweepInterval {
+		return
+	}
+	table.swept = now
+	for key, bucket := range table.buckets {
+		table.refill(bucket, now)
+		if bucket.tokens >= table.burst {
+			if bucket.limited {
+				table.logRecovery(key, bucket)
+			}
+			delete(table.buckets, key)
+		}
+	}
+}
+
+func (table *rateTable) logRecovery(key string, bucket *tokenBucket) {
+	Infof("Stopped rate limiting %s: %s, %d over the limit", table.name, key, bucket.overLimit)
+	bucket.limited = false
+	bucket.overLimit = 0
+}
+
+// rateLimiter limits the queries of each client prefix and, as in BIND's
+// response rate limiting, the identical responses sent to it. Only UDP
+// responses are limited, since the source of a TCP connection can't be
+// spoofed.
+type rateLimiter struct {
+	queries   *rateTable
+	responses *rateTable
+	ipv4Mask  net.IPMask
+	ipv6Mask  net.IPMask
+	exempt    []*net.IPNet
+}
+
+func newRateLimiter(rateConf RateLimitConfig) (*rateLimiter, error) {
+	ipv4Prefix, ipv6Prefix := rateConf.IPv4Prefix, rateConf.IPv6Prefix
+	if ipv4Prefix <= 0 || ipv4Prefix > 32 {
+		ipv4Prefix = defaultIPv4Prefix
+	}
+	if ipv6Prefix <= 0 || ipv6Prefix > 128 {
+		ipv6Prefix = defaultIPv6Prefix
+	}
+
+	exempt, err := parseNetworks(rateConf.Exempt)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimiter{
+		queries:   newRateTable("queries", rateConf.QueriesPerSecond, rateConf.QueryBurst, rateConf.Slip),
+		responses: newRateTable("responses", rateConf.ResponsesPerSecond, 0, rateConf.Slip),
+		ipv4Mask:  net.CIDRMask(ipv4Prefix, 32),
+		ipv6Mask:  net.CIDRMask(ipv6Prefix, 128),
+		exempt:    exempt,
+	}, nil
+}
+
+// getClientPrefix returns the network the limits of ip are kept for, false if
+// ip is exempt.
+func (limiter *rateLimiter) getClientPrefix(ip net.IP) (string, bool) {
+	if ip == nil || containsIP(limiter.exempt, ip) {
+		return "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ones, _ := limiter.ipv4Mask.Size()
+		return ip4.Mask(limiter.ipv4Mask).String() + "/" + strconv.Itoa(ones), true
+	}
+	ones, _ := limiter.ipv6Mask.Size()
+	return ip.Mask(limiter.ipv6Mask).String() + "/" + strconv.Itoa(ones), true
+}
+
+// limitQuery decides whether a query from ip is served. Over the limit, UDP
+// queries are dropped or slipped and queries over a stream are refused, which
+// is cheaper than a dropped query the client keeps waiting for.
+func (limiter *rateLimiter) limitQuery(ip net.IP, transport string) rateAction {
+	if limiter.queries == nil {
+		return rateAllow
+	}
+	prefix, ok := limiter.getClientPrefix(ip)
+	if !ok {
+		return rateAllow
+	}
+	action := limiter.queries.take(prefix)
+	if action != rateAllow && transport != transportUDP {
+		action = rateRefuse
+	}
+	countRateLimited("query", action)
+	return action
+}
+
+// limitResponse decides whether a UDP response is sent to ip. Responses are
+// identical when they have the same name, type and response code; negative
+// ones count per zone, so random names under it share a limit.
+func (limiter *rateLimiter) limitResponse(ip net.IP, dnsResponse layers.DNS) rateAction {
+	if limiter.responses == nil || len(dnsResponse.Questions) == 0 {
+		return rateAllow
+	}
+	prefix, ok := limiter.getClientPrefix(ip)
+	if !ok {
+		return rateAllow
+	}
+
+	question := dnsResponse.Questions[0]
+	key := prefix + " " + getResponseCodeName(dnsResponse.ResponseCode) + " " +
+		canonicalName(string(question.Name)) + ". " + getTypeName(question.Type)
+	if isNegativeResponse(dnsResponse) {
+		for _, rr := range getRecordsOfType(dnsResponse.Authorities, layers.DNSTypeSOA) {
+			key = prefix + " " + getResponseCodeName(dnsResponse.ResponseCode) + " " +
+				canonicalName(string(rr.Name)) + ". negative"
+		}
+	}
+
+	action := limiter.responses.take(key)
+	countRateLimited("response", action)
+	return action
+}
+
+// getSlipResponse is the empty, truncated answer sent in place of a rate
+// limited one. A genuine client retries over TCP; the target of a reflection
+// attack gets nothing larger than its query.
+func getSlipResponse(dnsIntReq layers.DNS) layers.DNS {
+	dnsResponse := getErrorResponse(dnsIntReq, layers.DNSResponseCodeNoErr)
+	dnsResponse.TC = true
+	return dnsResponse
+}
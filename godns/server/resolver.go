@@ -0,0 +1,231 @@
+package server
+
+import (
+	. "godns/cache"
+	. "godns/config"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	maxReferrals      = 16
+	maxServerAttempts = 3
+
+	// maxResolveDepth limits how many nameserver names without glue may be
+	// resolved inside each other.
+	maxResolveDepth = 4
+
+	maxServerRTT = time.Second * 5
+)
+
+// rttCache keeps a smoothed round trip time per server address, shared by the
+// root, TLD and authoritative servers met while resolving.
+type rttCache struct {
+	mu   sync.Mutex
+	srtt map[string]time.Duration
+}
+
+var serverRTTs = &rttCache{srtt: make(map[string]time.Duration)}
+
+// order sorts the addresses by smoothed RTT, fastest first. Addresses not seen
+// before get a small random SRTT so that each of them is tried and measured.
+// The ones that were not picked decay a little, so that a server which was
+// slow once is given another chance later.
+func (rc *rttCache) order(addresses []string) []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	var ordered []string
+	seen := make(map[string]bool)
+	for _, address := range addresses {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		ordered = append(ordered, address)
+		if _, found := rc.srtt[address]; !found {
+			rc.srtt[address] = time.Duration(1+rand.Intn(32)) * time.Millisecond
+		}
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rc.srtt[ordered[i]] < rc.srtt[ordered[j]]
+	})
+	for i := 1; i < len(ordered); i++ {
+		rc.srtt[ordered[i]] = rc.srtt[ordered[i]] * 49 / 50
+	}
+	return ordered
+}
+
+func (rc *rttCache) update(address string, rtt time.Duration) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.srtt[address] = (7*rc.srtt[address] + rtt) / 8
+}
+
+// penalize doubles the SRTT of a server that timed out or failed to answer.
+func (rc *rttCache) penalize(address string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	srtt := rc.srtt[address] * 2
+	if srtt < upstreamFailRTT {
+		srtt = upstreamFailRTT
+	}
+	if srtt > maxServerRTT {
+		srtt = maxServerRTT
+	}
+	rc.srtt[address] = srtt
+}
+
+// queryServers asks the servers in the order of their SRTT and fails over to
+// the next one on timeout, SERVFAIL or REFUSED. The last error response is
+// returned if no server gives a better one.
+func queryServers(state *serverState, servers []string, dnsIntReq layers.DNS, trace *queryTrace) (layers.DNS, bool) {
+	var lastResponse layers.DNS
+	var answered bool
+
+	for attempt, address := range serverRTTs.order(servers) {
+		if attempt == maxServerAttempts {
+			break
+		}
+		started := time.Now()
+		trace.addUpstream(address)
+		query := withNewID(dnsIntReq)
+		dnsResponse := resendToExternalWait4Response(state.tap, address, query)
+
+		countUpstreamQuery(getServerLabel(address), time.Since(started), len(dnsResponse.Contents) > 0)
+		if len(dnsResponse.Contents) == 0 || dnsResponse.ID != query.ID {
+			serverRTTs.penalize(address)
+			continue
+		}
+
+		switch dnsResponse.ResponseCode {
+		case layers.DNSResponseCodeServFail, layers.DNSResponseCodeRefused:
+			serverRTTs.penalize(address)
+			lastResponse, answered = dnsResponse, true
+			continue
+		}
+
+		serverRTTs.update(address, time.Since(started))
+		return dnsResponse, true
+	}
+	return lastResponse, answered
+}
+
+// resolveIteratively follows referrals from the root servers down to the
+// servers authoritative for the question and returns their answer.
+func resolveIteratively(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, depth int, trace *queryTrace) (layers.DNS, bool) {
+	qname := canonicalName(string(dnsIntReq.Questions[0].Name))
+	zone := ""
+	servers := rootServers.get(handler)
+
+	dnsIntReq.RD = false
+	dnsIntReq = getRebuiltDNSPacket(dnsIntReq)
+
+	var referral int
+	defer func() {
+		resolutionDepth.Observe(float64(referral))
+	}()
+	for ; referral < maxReferrals; referral++ {
+		dnsResponse, ok := queryServers(state, servers, dnsIntReq, trace)
+		if !ok {
+			return layers.DNS{}, false
+		}
+
+		nameservers := getRecordsOfType(dnsResponse.Authorities, layers.DNSTypeNS)
+		if !isReferral(dnsResponse, nameservers) {
+			return dnsResponse, true
+		}
+
+		cut := canonicalName(string(nameservers[0].Name))
+		if !isSubdomain(qname, cut) || len(nameLabels(cut)) <= len(nameLabels(zone)) {
+			return layers.DNS{}, false
+		}
+
+		servers = getGlueAddresses(nameservers, dnsResponse.Additionals, zone)
+		if len(servers) == 0 {
+			servers = resolveNameServers(handler, state, nameservers, cache, depth, trace)
+		}
+		if len(servers) == 0 {
+			return layers.DNS{}, false
+		}
+		zone = cut
+	}
+	return layers.DNS{}, false
+}
+
+// isReferral tells a delegation to child servers apart from an answer.
+func isReferral(dnsResponse layers.DNS, nameservers []layers.DNSResourceRecord) bool {
+	return dnsResponse.ResponseCode == layers.DNSResponseCodeNoErr &&
+		len(dnsResponse.Answers) == 0 &&
+		len(nameservers) > 0 &&
+		!isNegativeResponse(dnsResponse)
+}
+
+// getGlueAddresses collects the A and AAAA records for the nameservers from
+// the additional section. Only glue inside the zone of the server that sent
+// it is trusted.
+func getGlueAddresses(nameservers []layers.DNSResourceRecord, additionals []layers.DNSResourceRecord, zone string) []string {
+	var addresses []string
+	for _, ns := range nameservers {
+		name := canonicalName(string(ns.NS))
+		if !isSubdomain(name, zone) {
+			continue
+		}
+		for _, rr := range withoutOPT(additionals) {
+			if rr.Type != layers.DNSTypeA && rr.Type != layers.DNSTypeAAAA {
+				continue
+			}
+			if canonicalName(string(rr.Name)) == name {
+				addresses = append(addresses, rr.IP.String())
+			}
+		}
+	}
+	return addresses
+}
+
+// resolveNameServers looks up the addresses of nameservers that came without
+// usable glue, stopping at the first one that resolves.
+func resolveNameServers(handler *ConfigHandler, state *serverState, nameservers []layers.DNSResourceRecord, cache *Cache, depth int, trace *queryTrace) []string {
+	if depth >= maxResolveDepth {
+		return nil
+	}
+	for _, ns := range nameservers {
+		name := canonicalName(string(ns.NS))
+		cacheKey := NewKey([]byte(name), layers.DNSTypeA, layers.DNSClassIN)
+
+		var answers []layers.DNSResourceRecord
+		if item, found := cache.GetItem(cacheKey); found {
+			answers = item.Answers
+		} else {
+			dnsIntReq := getRebuiltDNSPacket(layers.DNS{
+				ID:     getRandomID(),
+				OpCode: layers.DNSOpCodeQuery,
+
+				Questions: []layers.DNSQuestion{{
+					Name:  []byte(name),
+					Type:  layers.DNSTypeA,
+					Class: layers.DNSClassIN,
+				}},
+			})
+			dnsResponse, ok := resolveIteratively(handler, state, dnsIntReq, cache, depth+1, trace)
+			if !ok {
+				continue
+			}
+			answers = cacheResponse(cache, cacheKey, dnsResponse).Answers
+		}
+
+		var addresses []string
+		for _, rr := range getRecordsOfType(answers, layers.DNSTypeA) {
+			addresses = append(addresses, rr.IP.String())
+		}
+		if len(addresses) > 0 {
+			return addresses
+		}
+	}
+	return nil
+}
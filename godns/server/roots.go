@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// primingRetryInterval is how long the hints are used before priming is tried
+// again after a failed attempt.
+const primingRetryInterval = time.Minute
+
+// rootServerList holds the addresses of the root servers. It starts with the
+// hints and is replaced by the answer to a priming query (RFC 8109), which is
+// repeated when the TTL of the root NS set runs out.
+type rootServerList struct {
+	mu          sync.Mutex
+	hints       []string
+	addresses   []string
+	primedUntil time.Time
+	priming     bool
+}
+
+var rootServers = &rootServerList{}
+
+// load reads the root hints file, or falls back to the single nameserver of
+// the config, and starts priming in the background.
+func (rs *rootServerList) load(handler *ConfigHandler) {
+	config := handler.Get()
+	hints := []string{config.Nameserver}
+	if config.RootHints != "" {
+		addresses, err := readRootHints(config.RootHints)
+		if err == nil && len(addresses) > 0 {
+			hints = addresses
+		} else {
+			Warnf("Can't read root hints, using nameserver %s instead", config.Nameserver)
+		}
+	}
+
+	rs.mu.Lock()
+	rs.hints = hints
+	rs.addresses = hints
+	rs.primedUntil = time.Time{}
+	rs.priming = !isForwardMode(config)
+	rs.mu.Unlock()
+
+	if !isForwardMode(config) {
+		go rs.prime(handler)
+	}
+}
+
+// get returns the current root server addresses and starts priming again once
+// the previous answer has expired.
+func (rs *rootServerList) get(handler *ConfigHandler) []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if !rs.priming && time.Now().After(rs.primedUntil) {
+		rs.priming = true
+		go rs.prime(handler)
+	}
+	return rs.addresses
+}
+
+// prime asks the root servers from the hints for the current root NS set and
+// its addresses.
+func (rs *rootServerList) prime(handler *ConfigHandler) {
+	rs.mu.Lock()
+	hints := rs.hints
+	rs.mu.Unlock()
+
+	var dnsIntReq layers.DNS = layers.DNS{
+		ID:     getRandomID(),
+		OpCode: layers.DNSOpCodeQuery,
+
+		Questions: []layers.DNSQuestion{{
+			Name:  []byte(""),
+			Type:  layers.DNSTypeNS,
+			Class: layers.DNSClassIN,
+		}},
+	}
+	state := acquireServerState()
+	dnsResponse, ok := queryServers(state, hints, getUpstreamRequest(handler.Get(), dnsIntReq), nil)
+	state.release()
+
+	var addresses []string
+	var nameservers []layers.DNSResourceRecord
+	if ok && dnsResponse.ResponseCode == layers.DNSResponseCodeNoErr {
+		nameservers = getRecordsOfType(dnsResponse.Answers, layers.DNSTypeNS)
+		addresses = getGlueAddresses(nameservers, dnsResponse.Additionals, "")
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.priming = false
+	if len(addresses) == 0 {
+		rs.primedUntil = time.Now().Add(primingRetryInterval)
+		Warnf("Root priming failed, using root hints")
+		return
+	}
+	rs.addresses = addresses
+	rs.primedUntil = time.Now().Add(time.Duration(MinTTL(nameservers)) * time.Second)
+}
+
+// isRoot reports whether address is a root server, from the hints or from the
+// last priming answer.
+func (rs *rootServerList) isRoot(address string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, addresses := range [][]string{rs.hints, rs.addresses} {
+		for _, root := range addresses {
+			if root == address {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readRootHints returns the A and AAAA addresses listed in a named.root file.
+func readRootHints(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var addresses []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		switch strings.ToUpper(fields[len(fields)-2]) {
+		case "A", "AAAA":
+			if ip := net.ParseIP(fields[len(fields)-1]); ip != nil {
+				addresses = append(addresses, ip.String())
+			}
+		}
+	}
+	return addresses, scanner.Err()
+}
@@ -3,201 +3,380 @@ package server
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	. "godns/cache"
 	. "godns/config"
+	. "godns/dnstap"
+	. "godns/logger"
 	"net"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
-var rootIP string
-
+// StartServer puts the config of handler in service and opens the listeners.
+// It exits when a part of the config can't be set up.
 func StartServer(handler *ConfigHandler, mainContext context.Context, cache *Cache) {
-	var config *ConfigInstance = handler.Get()
+	if err := applyConfig(handler, mainContext, cache, handler.Get()); err != nil {
+		Errorf("%v", err)
+		os.Exit(0)
+	}
+	loadCacheFile(handler.Get(), cache)
+	if err := updateListeners(handler, mainContext, cache); err != nil {
+		os.Exit(0)
+	}
+	Infof("DNS Server is up and running")
+}
 
-	var udpAddr = &net.UDPAddr{
-		IP:   net.ParseIP(config.Host),
-		Port: 53,
+// ReloadServer reads the config file again and swaps the new config in while
+// the server keeps answering. Listeners are rebound only if their address
+// changed; one that can't be rebound stays where it was. A config that can't
+// be read or set up is ignored, and the old one stays in service.
+func ReloadServer(handler *ConfigHandler, mainContext context.Context, cache *Cache) {
+	config, err := handler.Read()
+	if err != nil {
+		Errorf("Can't read config, keeping the old one: %v", err)
+		return
+	}
+	if err := applyConfig(handler, mainContext, cache, config); err != nil {
+		Errorf("%v, keeping the old config", err)
+		return
+	}
+	if err := updateListeners(handler, mainContext, cache); err != nil {
+		Errorf("Server is using updated config, but not all listeners could be updated: %v", err)
+		return
+	}
+	Infof("Server is now using updated config")
+}
+
+// applyConfig sets up everything config needs and then swaps it in. The parts
+// that may fail are prepared first, so on an error nothing has changed yet.
+func applyConfig(handler *ConfigHandler, mainContext context.Context, cache *Cache, config *ConfigInstance) error {
+	level, ok := ParseLevel(config.LogLevel)
+	if !ok {
+		Warnf("Unknown log-level %s, using info", config.LogLevel)
+	}
+	eviction, ok := ParseEvictionPolicy(config.CacheEviction)
+	if !ok {
+		Warnf("Unknown cache-eviction %s, using lru", config.CacheEviction)
 	}
-	conn, err := net.ListenUDP("udp", udpAddr)
 
+	limiter, err := newRateLimiter(config.RateLimit)
 	if err != nil {
-		fmt.Printf("\033[31mCan't start listening on port, %d\033[0m", 53)
-		fmt.Println(err)
-		os.Exit(0)
+		return fmt.Errorf("Can't set up rate limits: %v", err)
+	}
+
+	acl, err := newAccessControl(config.ACL)
+	if err != nil {
+		return fmt.Errorf("Can't set up access control: %v", err)
+	}
+
+	if isForwardMode(config) && len(config.Forward.Upstreams) == 0 {
+		return errors.New("Can't set up forwarding: mode forward needs at least one upstream")
+	}
+	forwarder, err := newForwarder(config.Forward)
+	if err != nil {
+		return fmt.Errorf("Can't set up forwarding: %v", err)
+	}
+	forwardRules, err := newForwardRules(config.ConditionalForward)
+	if err != nil {
+		forwarder.close()
+		return fmt.Errorf("Can't set up conditional forwarding for %v", err)
+	}
+	closeForwarders := func() {
+		forwarder.close()
+		forwardRules.close()
+	}
+
+	certificates, stopWatch, err := loadServerCertificates(config, mainContext)
+	if err != nil {
+		closeForwarders()
+		return fmt.Errorf("Can't load TLS certificate: %v", err)
+	}
+
+	logFile, err := openQueryLog(config)
+	if err != nil {
+		closeForwarders()
+		stopWatch()
+		return fmt.Errorf("Can't open query log %s: %v", config.QueryLog.File, err)
+	}
+
+	nextTap, err := openDnstap(config, mainContext, getServerState().tap)
+	if err != nil {
+		closeForwarders()
+		stopWatch()
+		if logFile != nil {
+			logFile.Close()
+		}
+		return fmt.Errorf("Can't open dnstap output: %v", err)
 	}
 
-	rootIP = handler.Get().Nameserver
-	fmt.Print("\033[32mDNS Server is up and running\n\033[0m")
-	go serveRequest(handler, mainContext, conn, cache)
+	handler.Set(config)
+	SetLevel(level)
+	stale := newStaleResolver(config.ServeStale)
+	cache.Configure(time.Minute*config.CacheExpiration, time.Minute*config.CacheCleanup, stale.window)
+	cache.SetLimits(config.CacheMaxEntries, config.CacheMaxMemory*1024*1024, eviction)
+	stopCacheSnapshots()
+	stopCacheSnapshots = startCacheSnapshots(mainContext, config, cache)
+
+	publishServerState(&serverState{
+		cache:                 cache,
+		rateLimits:            limiter,
+		clientACL:             acl,
+		upstreams:             forwarder,
+		conditionalForwarders: forwardRules,
+		certificates:          certificates,
+		prefetches:            newPrefetcher(config.Prefetch),
+		staleAnswers:          stale,
+		queryLog:              logFile,
+		tap:                   nextTap,
+	})
+	stopCertificateWatch()
+	stopCertificateWatch = stopWatch
+
+	rootServers.load(handler)
+	localZones.load(handler, mainContext)
+	staticHosts.load(handler, mainContext)
+	blocklists.load(handler, mainContext)
+	trustPoints.flush()
+	return nil
 }
 
-func serveRequest(handler *ConfigHandler, mainContext context.Context, intConn *net.UDPConn, cache *Cache) {
-	var buffer [1024]byte
+// serveRequest reads UDP queries until listenContext is done.
+func serveRequest(handler *ConfigHandler, listenContext context.Context, intConn *net.UDPConn, cache *Cache) {
+	buffer := make([]byte, maxTCPMessageSize)
 	for {
 		select {
-		case <-mainContext.Done():
+		case <-listenContext.Done():
 			intConn.Close()
 			return
 
 		default:
-			if handler.NeedRestart {
-				intConn.Close()
-				return
-			}
 			intConn.SetReadDeadline(time.Now().Add(time.Second * 1))
-			n, intAddr, _ := intConn.ReadFromUDP(buffer[:])
-			data := buffer[:]
+			n, intAddr, _ := intConn.ReadFromUDP(buffer)
 
 			if intAddr != nil {
-				newPacket := gopacket.NewPacket(buffer[:n], layers.LayerTypeDNS, gopacket.Default)
-				rawPacket := newPacket.Layer(layers.LayerTypeDNS)
-
-				if rawPacket != nil {
-					dnsInternalReq := rawPacket.(*layers.DNS)
-					if dnsInternalReq != nil {
-						go serveDNSPacket(handler, rootIP, *dnsInternalReq, cache, intConn, intAddr, data)
+				if dnsInternalReq, ok := decodeDNSPacket(buffer[:n]); ok {
+					state := acquireServerState()
+					switch state.rateLimits.limitQuery(intAddr.IP, transportUDP) {
+					case rateAllow:
+						go serveUDPPacket(handler, state, dnsInternalReq, cache, intConn, intAddr)
+						continue
+					case rateSlip:
+						sendUDPResponse(handler, dnsInternalReq, getSlipResponse(dnsInternalReq), intConn, intAddr)
 					}
+					state.release()
 				}
 			}
 		}
 	}
 }
 
-func serveDNSPacket(handler *ConfigHandler, dstServerIP string, dnsIntReq layers.DNS,
-	cache *Cache, intConn *net.UDPConn, intAddr *net.UDPAddr, data []byte) {
+// serveUDPPacket answers a query with state and releases it when done.
+func serveUDPPacket(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, intConn *net.UDPConn, intAddr *net.UDPAddr) {
+	defer state.release()
+	dnsResponse := serveDNSPacket(handler, state, dnsIntReq, cache, transportUDP, intAddr.String())
+	switch state.rateLimits.limitResponse(intAddr.IP, dnsResponse) {
+	case rateDrop:
+		return
+	case rateSlip:
+		dnsResponse = getSlipResponse(dnsIntReq)
+	}
+	sendUDPResponse(handler, dnsIntReq, dnsResponse, intConn, intAddr)
+}
 
-	var bytes []byte
-	var AAFlag bool
-	var NoResFlag bool
-	var dnsResponse layers.DNS
-	var initialReq layers.DNS = dnsIntReq
-	var depth int = 0
+func sendUDPResponse(handler *ConfigHandler, dnsIntReq layers.DNS, dnsResponse layers.DNS, intConn *net.UDPConn, intAddr *net.UDPAddr) {
+	maxSize := getClientUDPSize(handler.Get(), dnsIntReq)
+	intConn.WriteTo(getClientResponse(handler.Get(), dnsIntReq, dnsResponse, maxSize), intAddr)
+}
 
-	// item := append(dnsIntReq.Questions[0].Name, ([]byte(dnsIntReq.Questions[0].Type.String()))...)
+// serveDNSPacket is the resolution pipeline shared by all client transports.
+// It returns the response to send back, SERVFAIL if no answer was found, so
+// clients over every transport learn of a failure instead of timing out. The
+// whole query is answered with state, the one the transport loaded for it.
+func serveDNSPacket(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, transport string, client string) layers.DNS {
+	inflightQueries.Inc()
+	defer inflightQueries.Dec()
+
+	started := time.Now()
+	trace := &queryTrace{}
+	tapClientQuery(state.tap, dnsIntReq, transport, client, started)
+	clientIP, _ := splitAddress(client)
+	dnsResponse, ok := answerDNSPacket(handler, state, dnsIntReq, cache, state.clientACL.check(clientIP), trace)
+	if !ok {
+		dnsResponse = getErrorResponse(dnsIntReq, layers.DNSResponseCodeServFail)
+	}
+	tapClientResponse(state.tap, handler, dnsIntReq, dnsResponse, transport, client, started)
+	countQuery(dnsIntReq, transport, dnsResponse)
+	logQuery(state.queryLog, dnsIntReq, transport, client, dnsResponse, trace, time.Since(started))
+	return dnsResponse
+}
 
-	for {
-		if depth > 14 {
-			return
-		}
+// answerDNSPacket answers a question as far as the client has access: clients
+// limited to local data get the hosts and zones only, and are refused
+// anything else.
+func answerDNSPacket(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, access clientAccess, trace *queryTrace) (layers.DNS, bool) {
+	if len(dnsIntReq.Questions) == 0 {
+		return layers.DNS{}, false
+	}
 
-		bytes, AAFlag, dnsResponse, NoResFlag = sendDNSRequest(dstServerIP, dnsIntReq, AAFlag, NoResFlag, cache)
-		if len(bytes) == 0 {
-			return
-		}
+	if access == accessDenied {
+		return getErrorResponse(dnsIntReq, layers.DNSResponseCodeRefused), true
+	}
 
-		if dnsResponse.ResponseCode.String() == "Server Failure " {
-			dstServerIP = handler.Get().Nameserver
-			NoResFlag = true
-			continue
-		}
+	if getEDNSOptions(dnsIntReq).version > 0 {
+		return getErrorResponse(dnsIntReq, dnsResponseCodeBadVers), true
+	}
 
-		if dnsResponse.Questions[0].Type == layers.DNSTypePTR {
-			if checkPTR2LocalResolver(dnsResponse) {
-				intConn.WriteTo(getSerializedDNSPacket(dnsResponse), intAddr)
-				return
-			}
-		} else if dnsResponse.Questions[0].Type == layers.DNSTypeNS {
-			if strings.ToLower(string(dnsResponse.Authorities[0].Name)) == string(initialReq.Questions[0].Name) {
-				intConn.WriteTo(getSerializedDNSPacket(dnsResponse), intAddr)
-				return
-			}
-		}
+	if dnsResponse, ok := getHostsResponse(dnsIntReq); ok {
+		return dnsResponse, true
+	}
 
-		if AAFlag {
-			if string(dnsIntReq.Questions[0].Name) == string(initialReq.Questions[0].Name) {
-				intConn.WriteTo(getSerializedDNSPacket(dnsResponse), intAddr)
-				return
-			} else {
-				newReq := getATypeReqForName(dnsIntReq, string(initialReq.Questions[0].Name))
-				dnsIntReq = newReq
-			}
+	if dnsResponse, ok := getLocalResponse(dnsIntReq); ok {
+		if access == accessLocal {
+			return dnsResponse, true
 		}
+		return chaseCNAMEs(handler, state, dnsIntReq, dnsResponse, cache, trace)
+	}
 
-		rawAddr := net.ParseIP(string(bytes))
-		if rawAddr != nil {
-			dstServerIP = rawAddr.String()
-		} else {
-			newReq := getATypeReqForName(dnsIntReq, string(bytes))
-			dnsIntReq = newReq
-			dstServerIP = handler.Get().Nameserver
-		}
+	if access == accessLocal {
+		return getErrorResponse(dnsIntReq, layers.DNSResponseCodeRefused), true
+	}
 
-		depth += 1
+	if question := dnsIntReq.Questions[0]; question.Class == layers.DNSClassIN {
+		if rule, blocked := blocklists.match(string(question.Name)); blocked {
+			return getBlockedResponse(handler, state, dnsIntReq, rule, cache, trace)
+		}
 	}
-}
 
-func sendDNSRequest(dstServerIP string, dnsIntReq layers.DNS, AAFlag bool, NoResFlag bool, cache *Cache) ([]byte, bool, layers.DNS, bool) {
+	dnsResponse, ok := lookupDNSPacket(handler, state, dnsIntReq, cache, trace)
+	if !ok {
+		return layers.DNS{}, false
+	}
 
-	for _, quest := range dnsIntReq.Questions {
+	dnsResponse.Z &^= dnsFlagAD
+	if handler.Get().DNSSEC && dnsIntReq.Z&dnsFlagCD == 0 {
+		return getValidatedResponse(handler, state, cache, dnsIntReq, dnsResponse), true
+	}
+	return dnsResponse, true
+}
 
-		switch quest.Type {
-		case layers.DNSTypeA:
-			return serveDomain2IP(dstServerIP, dnsIntReq, AAFlag, NoResFlag)
+// lookupDNSPacket answers from the cache or has the question resolved by
+// resolveDNSPacket, falling back to an expired entry if that fails.
+func lookupDNSPacket(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, trace *queryTrace) (layers.DNS, bool) {
+	if len(dnsIntReq.Questions) == 0 {
+		return layers.DNS{}, false
+	}
+	question := dnsIntReq.Questions[0]
+	cacheKey := NewKey(question.Name, question.Type, question.Class)
 
-		case layers.DNSTypeAAAA:
-			return serveDomain2IP(dstServerIP, dnsIntReq, AAFlag, NoResFlag)
+	if item, found := cache.GetItem(cacheKey); found {
+		trace.setCacheHit()
+		state.prefetches.check(handler, state, dnsIntReq, cache, cacheKey, item)
+		return getCachedReply(dnsIntReq, item), true
+	}
 
-		case layers.DNSTypePTR:
-			if string(quest.Name) == "1.0.0.127.in-addr.arpa" {
-				replyMess := getPTRecord4LocalResolver(dnsIntReq)
-				bytes := getSerializedDNSPacket(replyMess)
-				return bytes, AAFlag, replyMess, NoResFlag
+	if checkPTR2LocalResolver(dnsIntReq) {
+		return getPTRecord4LocalResolver(dnsIntReq), true
+	}
+	if isZoneTransfer(question.Type) {
+		return getErrorResponse(dnsIntReq, layers.DNSResponseCodeNotImp), true
+	}
+	return state.staleAnswers.lookup(handler, state, dnsIntReq, cache, cacheKey, trace)
+}
 
-			} else {
-				return serveDomain2IP(dstServerIP, dnsIntReq, AAFlag, NoResFlag)
-			}
+// refreshDNSPacket resolves the question without looking at the cache entry
+// for it, and caches the answer.
+func refreshDNSPacket(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, cacheKey []byte, trace *queryTrace) (layers.DNS, bool) {
+	dnsResponse, ok := resolveDNSPacket(handler, state, dnsIntReq, cache, trace)
+	if ok && !isForwardMode(handler.Get()) {
+		dnsResponse, ok = chaseCNAMEs(handler, state, dnsIntReq, dnsResponse, cache, trace)
+	}
+	if !ok {
+		return layers.DNS{}, false
+	}
+	dnsResponse.ID = dnsIntReq.ID
+	dnsResponse.RD = dnsIntReq.RD
+	dnsResponse.RA = true
+	dnsResponse.AA = false
+	return cacheResponse(cache, cacheKey, dnsResponse), true
+}
 
-		case layers.DNSTypeNS:
-			return serveDomain2IP(dstServerIP, dnsIntReq, AAFlag, NoResFlag)
+// resolveDNSPacket sends the question to the upstreams of the matching
+// conditional forwarding rule, to the upstream resolvers in forward mode, or
+// resolves it iteratively starting at the root servers.
+func resolveDNSPacket(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, trace *queryTrace) (layers.DNS, bool) {
+	upstreamReq := getUpstreamRequest(handler.Get(), dnsIntReq)
+	if fwd := state.conditionalForwarders.match(string(dnsIntReq.Questions[0].Name)); fwd != nil {
+		return forwardDNSPacket(state, fwd, upstreamReq, trace)
+	}
+	if isForwardMode(handler.Get()) {
+		return forwardDNSPacket(state, state.upstreams, upstreamReq, trace)
+	}
+	return resolveIteratively(handler, state, upstreamReq, cache, 0, trace)
+}
 
-		}
+func cacheResponse(cache *Cache, cacheKey []byte, dnsResponse layers.DNS) layers.DNS {
+	if isNegativeResponse(dnsResponse) {
+		cache.AddNegative(cacheKey, dnsResponse.ResponseCode, dnsResponse.Answers, dnsResponse.Authorities)
+	} else if dnsResponse.ResponseCode == layers.DNSResponseCodeNoErr {
+		cache.Add(cacheKey, dnsResponse.Answers, dnsResponse.Authorities, dnsResponse.Additionals)
 	}
-	return []byte(""), AAFlag, layers.DNS{}, NoResFlag
+	return dnsResponse
 }
 
-func serveDomain2IP(dstServerIP string, dnsIntReq layers.DNS, AAFlag bool, NoResFlag bool) ([]byte, bool, layers.DNS, bool) {
-	dnsResponse := resendToExternalWait4Response(dstServerIP, dnsIntReq)
+func getErrorResponse(dnsIntReq layers.DNS, rcode layers.DNSResponseCode) layers.DNS {
+	var replyMess layers.DNS = layers.DNS{
+		ID: dnsIntReq.ID,
 
-	if len(dnsResponse.Contents) == 0 {
-		return []byte(""), AAFlag, layers.DNS{}, NoResFlag
-	}
+		QR: true,
+		RD: dnsIntReq.RD,
+		RA: true,
 
-	if dnsResponse.AA {
-		AAFlag = true
+		ResponseCode: rcode,
+		OpCode:       dnsIntReq.OpCode,
+		Questions:    dnsIntReq.Questions,
 	}
 
-	if dnsResponse.ResponseCode == 2 && !NoResFlag {
-		return dnsIntReq.Contents, AAFlag, dnsResponse, NoResFlag
-	}
+	return replyMess
+}
 
-	if len(dnsResponse.Additionals) > 0 {
-		for _, addRecord := range dnsResponse.Additionals {
-			if addRecord.IP.To4() == nil {
-				continue
-			}
-			if NoResFlag {
-				NoResFlag = false
-				continue
-			}
-			NoResFlag = false
-			dstServerIP = addRecord.IP.String()
-			return []byte(dstServerIP), AAFlag, dnsResponse, NoResFlag
-		}
+func getCachedReply(dnsIntReq layers.DNS, item CacheItem) layers.DNS {
+	var replyMess layers.DNS = layers.DNS{
+		ID: dnsIntReq.ID,
+
+		QR: true,
+		RD: dnsIntReq.RD,
+		RA: true,
+		AA: false,
+		TC: false,
+
+		ResponseCode: item.ResponseCode,
 
-	} else if len(dnsResponse.Authorities) > 0 {
-		return dnsResponse.Authorities[0].NS, AAFlag, dnsResponse, NoResFlag
+		QDCount: uint16(len(dnsIntReq.Questions)),
+		ANCount: uint16(len(item.Answers)),
+		NSCount: uint16(len(item.Authorities)),
+		ARCount: uint16(len(item.Additionals)),
 
-	} else if len(dnsResponse.Answers) > 0 {
-		return []byte(dnsResponse.Answers[0].IP.String()), AAFlag, dnsResponse, NoResFlag
+		OpCode:      layers.DNSOpCodeQuery,
+		Questions:   dnsIntReq.Questions,
+		Answers:     item.Answers,
+		Authorities: item.Authorities,
+		Additionals: item.Additionals,
 	}
-	return []byte(""), AAFlag, layers.DNS{}, NoResFlag
+
+	return replyMess
+}
+
+// isZoneTransfer reports whether the question asks for a zone transfer, which
+// a resolver does not serve.
+func isZoneTransfer(qtype layers.DNSType) bool {
+	return qtype == dnsTypeAXFR || qtype == dnsTypeIXFR
 }
 
 func getPTRecord4LocalResolver(dnsIntReq layers.DNS) layers.DNS {
@@ -229,51 +408,57 @@ func getPTRecord4LocalResolver(dnsIntReq layers.DNS) layers.DNS {
 	return replyMess
 }
 
-func getATypeReqForName(dnsIntReq layers.DNS, newName string) layers.DNS {
-
-	newDNSReq := dnsIntReq
-
-	var dnsQuest layers.DNSQuestion
-	dnsQuest.Class = layers.DNSClassIN
-	dnsQuest.Type = layers.DNSTypeA
-	dnsQuest.Name = []byte(newName)
-
-	newDNSReq.Questions = []layers.DNSQuestion{dnsQuest}
-
-	test := getSerializedDNSPacket(newDNSReq)
-	decoded := gopacket.NewPacket([]byte(test), layers.LayerTypeDNS, gopacket.Default)
-	test2 := decoded.Layer(layers.LayerTypeDNS).(*layers.DNS)
+// getRebuiltDNSPacket serializes and decodes the message again, so that its
+// Contents match the fields and can be sent upstream as is.
+func getRebuiltDNSPacket(dnsMessage layers.DNS) layers.DNS {
+	rebuilt, _ := decodeDNSPacket(getSerializedDNSPacket(dnsMessage))
+	return rebuilt
+}
 
-	test3 := *test2
+// withNewID gives a query to another server an ID of its own, so that the ID
+// of a client query never leaves the server and a late answer to an earlier
+// attempt is not taken for the answer to this one.
+func withNewID(dnsIntReq layers.DNS) layers.DNS {
+	dnsIntReq.ID = getRandomID()
+	dnsIntReq.Contents = append([]byte(nil), dnsIntReq.Contents...)
+	binary.BigEndian.PutUint16(dnsIntReq.Contents, dnsIntReq.ID)
+	return dnsIntReq
+}
 
-	return test3
+// getRandomID returns an ID for a query to another server. It comes from
+// crypto/rand: an ID that can be guessed lets an off-path attacker spoof the
+// answer and poison the cache.
+func getRandomID() uint16 {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint16(id[:])
 }
 
 func getSerializedDNSPacket(replyMess layers.DNS) []byte {
-	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{}
-	err := replyMess.SerializeTo(buf, opts)
+	return packDNSMessage(replyMess)
+}
 
-	if err != nil {
-		panic(err)
+// getServerAddr appends defaultPort to addresses given without a port.
+func getServerAddr(dstServerIP string, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(dstServerIP); err == nil {
+		return dstServerIP
 	}
-	return buf.Bytes()
+	return net.JoinHostPort(dstServerIP, defaultPort)
 }
 
-func openExternalConn(dstServerIP string) (*net.UDPConn, error) {
-	udpExternal := &net.UDPAddr{
-		Port: 53,
-		IP:   net.ParseIP(dstServerIP),
-	}
-	extConn, err := net.DialUDP("udp", nil, udpExternal)
+func openExternalConn(dstServerIP string) (net.Conn, error) {
+	udpExternal := getServerAddr(dstServerIP, "53")
+	extConn, err := net.Dial("udp", udpExternal)
 	if err != nil {
-		fmt.Println("\033[31mUnable to establish connection to External DNS server\033[0m", udpExternal)
+		Warnf("Unable to establish connection to External DNS server %s: %v", udpExternal, err)
 		return nil, err
 	}
 	return extConn, nil
 }
 
-func resendToExternalWait4Response(dstServerIP string, dnsIntReq layers.DNS) layers.DNS {
+func resendToExternalWait4Response(tap *dnstapTap, dstServerIP string, dnsIntReq layers.DNS) layers.DNS {
 
 	extConn, err := openExternalConn(dstServerIP)
 	if err == nil {
@@ -282,22 +467,82 @@ func resendToExternalWait4Response(dstServerIP string, dnsIntReq layers.DNS) lay
 		return layers.DNS{}
 	}
 
-	p := make([]byte, 2048)
+	p := make([]byte, 65535)
+	queryTime := time.Now()
 	extConn.Write(dnsIntReq.Contents)
+	tapResolverQuery(tap, extConn, ProtocolUDP, dnsIntReq.Contents, queryTime)
 
 	extConn.SetReadDeadline(time.Now().Add(time.Second / 2))
 	n, err := bufio.NewReader(extConn).Read(p)
 
 	if err != nil {
-		fmt.Println(errors.New("Timeout"))
+		Warnf("No answer from %s to %s: %v", dstServerIP, getQuestionText(dnsIntReq), err)
+		return layers.DNS{}
+	}
+	tapResolverResponse(tap, extConn, ProtocolUDP, dnsIntReq.Contents, queryTime, p[:n])
+
+	dnsResponse, ok := decodeDNSPacket(p[:n])
+	if !ok {
+		return layers.DNS{}
+	}
+
+	if dnsResponse.ResponseCode == layers.DNSResponseCodeFormErr && getEDNSOptions(dnsIntReq).present {
+		return resendToExternalWait4Response(tap, dstServerIP, getPlainRequest(dnsIntReq))
 	}
 
-	rawPacket := gopacket.NewPacket(p[:n], layers.LayerTypeDNS, gopacket.Default)
-	dnsResponse := rawPacket.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if dnsResponse.TC {
+		return resendOverTCPWait4Response(tap, dstServerIP, dnsIntReq)
+	}
+	return dnsResponse
+}
+
+func decodeDNSPacket(data []byte) (layers.DNS, bool) {
+	rawPacket := gopacket.NewPacket(data, layers.LayerTypeDNS, gopacket.Default)
+	dnsLayer := rawPacket.Layer(layers.LayerTypeDNS)
+	if dnsLayer == nil {
+		return layers.DNS{}, false
+	}
+	return *dnsLayer.(*layers.DNS), true
+}
+
+// getQuestionText describes the question of a message for log messages.
+func getQuestionText(dnsMessage layers.DNS) string {
+	if len(dnsMessage.Questions) == 0 {
+		return "a query without question"
+	}
+	question := dnsMessage.Questions[0]
+	return string(question.Name) + " " + getTypeName(question.Type)
+}
 
-	return *dnsResponse
+func checkPTR2LocalResolver(dnsIntReq layers.DNS) bool {
+	return dnsIntReq.Questions[0].Type == layers.DNSTypePTR &&
+		string(dnsIntReq.Questions[0].Name) == "1.0.0.127.in-addr.arpa"
 }
 
-func checkPTR2LocalResolver(dnsResponse layers.DNS) bool {
-	return string(dnsResponse.Questions[0].Name) == "1.0.0.127.in-addr.arpa"
+// isNegativeResponse reports whether the response is an NXDOMAIN or a NODATA
+// answer in the sense of RFC 2308. A NODATA answer is told apart from a referral
+// by the SOA record in its authority section.
+func isNegativeResponse(dnsResponse layers.DNS) bool {
+	if dnsResponse.ResponseCode == layers.DNSResponseCodeNXDomain {
+		return true
+	}
+	if dnsResponse.ResponseCode != layers.DNSResponseCodeNoErr || len(dnsResponse.Answers) > 0 {
+		return false
+	}
+	for _, rr := range dnsResponse.Authorities {
+		if rr.Type == layers.DNSTypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+func getRecordsOfType(records []layers.DNSResourceRecord, rrType layers.DNSType) []layers.DNSResourceRecord {
+	var filtered []layers.DNSResourceRecord
+	for _, rr := range records {
+		if rr.Type == rrType {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
 }
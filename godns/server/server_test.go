@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	. "godns/cache"
+	. "godns/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func newTestHandler(t *testing.T, configData string) *ConfigHandler {
+	configPath := filepath.Join(t.TempDir(), "conf.yaml")
+	if err := os.WriteFile(configPath, []byte(configData), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewConfigHandler(configPath, ctx)
+}
+
+func TestForwardModeNeedsUpstreams(t *testing.T) {
+	handler := newTestHandler(t, "mode: forward\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	before := getServerState()
+
+	err := applyConfig(handler, ctx, NewCache(0, time.Minute, ctx), handler.Get())
+	if err == nil || !strings.Contains(err.Error(), "upstream") {
+		t.Errorf("forward mode without upstreams got error %v", err)
+	}
+	if getServerState() != before {
+		t.Error("the config was put in service")
+	}
+}
+
+func TestConditionalForwardingNeedsUpstreams(t *testing.T) {
+	_, err := newForwardRules([]ConditionalForwardConfig{{Domain: "corp.test"}})
+	if err == nil {
+		t.Error("a rule without upstreams was accepted")
+	}
+}
+
+func TestFailedResolutionIsServFail(t *testing.T) {
+	handler := newTestHandler(t, "mode: forward\n")
+	acl, err := newAccessControl(AccessControlConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &serverState{
+		clientACL:    acl,
+		upstreams:    &forwarder{},
+		prefetches:   &prefetcher{},
+		staleAnswers: &staleResolver{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	query := layers.DNS{
+		ID:        4711,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte("www.example.test"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	}
+	dnsResponse := serveDNSPacket(handler, state, query, NewCache(0, time.Minute, ctx), transportUDP, "192.0.2.1:5353")
+	if !dnsResponse.QR || dnsResponse.ID != query.ID || dnsResponse.ResponseCode != layers.DNSResponseCodeServFail {
+		t.Errorf("got response %d with %v, want %d with ServFail", dnsResponse.ID, dnsResponse.ResponseCode, query.ID)
+	}
+}
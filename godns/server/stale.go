@@ -0,0 +1,152 @@
+package server
+
+import (
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	defaultStaleAnswerTTL      = 30
+	defaultStaleClientTimeout  = 1800 * time.Millisecond
+	defaultStaleRefreshBackoff = 30 * time.Second
+)
+
+// staleResolver answers from expired cache entries when a name can't be
+// resolved, as in RFC 8767. A fresh answer is tried first, but a client waits
+// for it no longer than clientTimeout; the resolution goes on in the
+// background and caches what it gets. After a failed attempt the name is
+// answered stale right away, and resolved again no sooner than backoff later.
+type staleResolver struct {
+	window        time.Duration
+	answerTTL     uint32
+	clientTimeout time.Duration
+	backoff       time.Duration
+
+	mu       sync.Mutex
+	attempts map[string]time.Time
+	swept    time.Time
+}
+
+func newStaleResolver(staleConf ServeStaleConfig) *staleResolver {
+	if staleConf.MaxStale <= 0 {
+		return &staleResolver{}
+	}
+	answerTTL := staleConf.AnswerTTL
+	if answerTTL == 0 {
+		answerTTL = defaultStaleAnswerTTL
+	}
+	clientTimeout := staleConf.ClientTimeout * time.Millisecond
+	if clientTimeout <= 0 {
+		clientTimeout = defaultStaleClientTimeout
+	}
+	backoff := staleConf.RefreshBackoff * time.Second
+	if backoff <= 0 {
+		backoff = defaultStaleRefreshBackoff
+	}
+	return &staleResolver{
+		window:        staleConf.MaxStale * time.Minute,
+		answerTTL:     answerTTL,
+		clientTimeout: clientTimeout,
+		backoff:       backoff,
+		attempts:      make(map[string]time.Time),
+		swept:         time.Now(),
+	}
+}
+
+// lookup resolves a question that has an expired entry in the cache, and
+// answers with that entry if no fresh answer comes in time.
+func (sr *staleResolver) lookup(handler *ConfigHandler, state *serverState, dnsIntReq layers.DNS, cache *Cache, cacheKey []byte, trace *queryTrace) (layers.DNS, bool) {
+	if sr.attempts == nil {
+		return refreshDNSPacket(handler, state, dnsIntReq, cache, cacheKey, trace)
+	}
+	item, found := cache.GetStaleItem(cacheKey, sr.answerTTL)
+	if !found {
+		return refreshDNSPacket(handler, state, dnsIntReq, cache, cacheKey, trace)
+	}
+	if !sr.startAttempt(string(cacheKey)) {
+		return sr.answer(dnsIntReq, item, trace, "backoff")
+	}
+
+	type result struct {
+		dnsResponse layers.DNS
+		ok          bool
+	}
+	done := make(chan result, 1)
+	attemptTrace := &queryTrace{}
+	// The attempt goes on after a timeout has answered the client.
+	state.hold()
+	go func() {
+		defer state.release()
+		dnsResponse, ok := refreshDNSPacket(handler, state, dnsIntReq, cache, cacheKey, attemptTrace)
+		ok = ok && dnsResponse.ResponseCode != layers.DNSResponseCodeServFail
+		sr.endAttempt(string(cacheKey), ok)
+		done <- result{dnsResponse, ok}
+	}()
+
+	select {
+	case res := <-done:
+		for _, address := range attemptTrace.upstreams {
+			trace.addUpstream(address)
+		}
+		if res.ok {
+			return res.dnsResponse, true
+		}
+		return sr.answer(dnsIntReq, item, trace, "failed")
+	case <-time.After(sr.clientTimeout):
+		return sr.answer(dnsIntReq, item, trace, "timeout")
+	}
+}
+
+func (sr *staleResolver) answer(dnsIntReq layers.DNS, item CacheItem, trace *queryTrace, reason string) (layers.DNS, bool) {
+	question := dnsIntReq.Questions[0]
+	Debugf("Serving stale %s %s (%s)", string(question.Name), getTypeName(question.Type), reason)
+	trace.setCacheHit()
+	trace.setStale()
+	staleAnswersTotal.Inc(reason)
+	return getCachedReply(dnsIntReq, item), true
+}
+
+// startAttempt reports whether the name may be resolved now, and if so
+// records the attempt, so queries for it in the meantime get the stale answer
+// without waiting.
+func (sr *staleResolver) startAttempt(key string) bool {
+	now := time.Now()
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.sweep(now)
+
+	if last, found := sr.attempts[key]; found && now.Sub(last) < sr.backoff {
+		return false
+	}
+	sr.attempts[key] = now
+	return true
+}
+
+// endAttempt forgets the attempts on a name once it was resolved. After a
+// failure the attempt is kept, and the name is backed off.
+func (sr *staleResolver) endAttempt(key string, ok bool) {
+	if !ok {
+		return
+	}
+	sr.mu.Lock()
+	delete(sr.attempts, key)
+	sr.mu.Unlock()
+}
+
+// sweep forgets the attempts that no longer hold anything back.
+func (sr *staleResolver) sweep(now time.Time) {
+	if now.Sub(sr.swept) < sr.backoff {
+		return
+	}
+	sr.swept = now
+	for key, last := range sr.attempts {
+		if now.Sub(last) >= sr.backoff {
+			delete(sr.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	"sync/atomic"
+)
+
+// serverState is everything a reload replaces besides the config. It is
+// never changed once published: a reload builds a new one and swaps it in,
+// and a query holds it for its whole life, so it never sees half of the old
+// setup and half of the new one. A replaced state is closed only once the
+// last query holding it is done.
+type serverState struct {
+	cache                 *Cache
+	rateLimits            *rateLimiter
+	clientACL             *accessControl
+	upstreams             *forwarder
+	conditionalForwarders forwardRules
+	certificates          *CertificateHandler
+	prefetches            *prefetcher
+	staleAnswers          *staleResolver
+	queryLog              *RotatingFile
+	tap                   *dnstapTap
+
+	// refs counts the queries holding the state, plus one while it is in
+	// service.
+	refs int32
+}
+
+// currentState holds the *serverState in service. Until the server starts it
+// has no limits, access control, prefetching, serve-stale, query log or
+// dnstap, and forwards to nobody.
+var currentState atomic.Value
+
+func init() {
+	currentState.Store(&serverState{
+		rateLimits:   &rateLimiter{},
+		clientACL:    &accessControl{},
+		upstreams:    &forwarder{strategy: strategySequential, maxFails: defaultMaxFails, cooldown: defaultCooldown},
+		prefetches:   &prefetcher{},
+		staleAnswers: &staleResolver{},
+		refs:         1,
+	})
+}
+
+// getServerState returns the state in service for a quick look at parts that
+// are never closed, like the cache or the certificates. Queries use
+// acquireServerState instead.
+func getServerState() *serverState {
+	return currentState.Load().(*serverState)
+}
+
+// acquireServerState returns the state in service, held until release is
+// called.
+func acquireServerState() *serverState {
+	for {
+		state := getServerState()
+		refs := atomic.LoadInt32(&state.refs)
+		// A state without references has been replaced and closed, and its
+		// successor is already published.
+		if refs > 0 && atomic.CompareAndSwapInt32(&state.refs, refs, refs+1) {
+			return state
+		}
+	}
+}
+
+// hold takes another reference for work that outlives the query holding the
+// state, like a prefetch.
+func (state *serverState) hold() {
+	atomic.AddInt32(&state.refs, 1)
+}
+
+func (state *serverState) release() {
+	if atomic.AddInt32(&state.refs, -1) == 0 {
+		state.close()
+	}
+}
+
+// publishServerState puts state in service. The state it replaces is closed
+// when the queries still holding it are done.
+func publishServerState(state *serverState) {
+	state.refs = 1
+	old := getServerState()
+	currentState.Store(state)
+	old.release()
+}
+
+func (state *serverState) close() {
+	state.upstreams.close()
+	state.conditionalForwarders.close()
+	if state.queryLog != nil {
+		state.queryLog.Close()
+	}
+	closeDnstap(state.tap)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestReplacedStateOutlivesItsQueries(t *testing.T) {
+	saved := getServerState()
+	t.Cleanup(func() {
+		atomic.StoreInt32(&saved.refs, 1)
+		currentState.Store(saved)
+	})
+
+	pool := &dotPool{}
+	isClosed := func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return pool.closed
+	}
+	first := &serverState{upstreams: &forwarder{upstreams: []*upstream{{dot: pool}}}}
+	publishServerState(first)
+	held := acquireServerState()
+	if held != first {
+		t.Fatal("the query didn't get the state in service")
+	}
+
+	second := &serverState{upstreams: &forwarder{}}
+	publishServerState(second)
+	if isClosed() {
+		t.Fatal("the replaced state was closed while a query still held it")
+	}
+	if state := acquireServerState(); state != second {
+		t.Error("a new query got the replaced state")
+	} else {
+		state.release()
+	}
+
+	held.release()
+	if !isClosed() {
+		t.Error("the replaced state was not closed after its last query")
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	. "godns/cache"
+	. "godns/config"
+	. "godns/dnstap"
+	. "godns/logger"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const defaultTCPIdleTimeout = 10 * time.Second
+
+func listenUDP(config *ConfigInstance) (*net.UDPConn, error) {
+	var udpAddr = &net.UDPAddr{
+		IP:   net.ParseIP(config.Host),
+		Port: 53,
+	}
+	return net.ListenUDP("udp", udpAddr)
+}
+
+func listenTCP(config *ConfigInstance) (*net.TCPListener, error) {
+	var tcpAddr = &net.TCPAddr{
+		IP:   net.ParseIP(config.Host),
+		Port: 53,
+	}
+	return net.ListenTCP("tcp", tcpAddr)
+}
+
+// serveTCPConnections accepts client connections until listenContext is done.
+// With tlsConfig set, the connections speak DNS-over-TLS. The idle timeout of
+// each connection comes from the config in service when it is accepted.
+func serveTCPConnections(handler *ConfigHandler, listenContext context.Context, listener *net.TCPListener, tlsConfig *tls.Config, idleTimeout func(*ConfigInstance) time.Duration, cache *Cache) {
+	for {
+		select {
+		case <-listenContext.Done():
+			listener.Close()
+			return
+
+		default:
+			listener.SetDeadline(time.Now().Add(time.Second * 1))
+			intConn, err := listener.Accept()
+			if err != nil {
+				continue
+			}
+			if tlsConfig != nil {
+				intConn = tls.Server(intConn, tlsConfig)
+			}
+			go serveTCPConnection(handler, listenContext, intConn, idleTimeout(handler.Get()), cache)
+		}
+	}
+}
+
+// serveTCPConnection reads length-prefixed queries from a single client
+// connection (RFC 1035 section 4.2.2). The connection is kept open for further
+// queries until the client stays silent for longer than the idle timeout, as
+// RFC 7766 suggests. Queries are resolved concurrently and answered in the
+// order they complete, so responses may come out of order.
+func serveTCPConnection(handler *ConfigHandler, listenContext context.Context, intConn net.Conn, idleTimeout time.Duration, cache *Cache) {
+	defer intConn.Close()
+
+	var writeMu sync.Mutex
+	transport := transportTCP
+	if _, isTLS := intConn.(*tls.Conn); isTLS {
+		transport = transportDoT
+	}
+	clientIP, _ := splitAddress(intConn.RemoteAddr().String())
+
+	for {
+		if listenContext.Err() != nil {
+			return
+		}
+		intConn.SetReadDeadline(time.Now().Add(idleTimeout))
+		data, err := readTCPMessage(intConn)
+		if err != nil {
+			return
+		}
+
+		dnsIntReq, ok := decodeDNSPacket(data)
+		if !ok {
+			return
+		}
+
+		state := acquireServerState()
+		if state.rateLimits.limitQuery(clientIP, transport) != rateAllow {
+			state.release()
+			writeMu.Lock()
+			intConn.SetWriteDeadline(time.Now().Add(idleTimeout))
+			writeTCPMessage(intConn, getClientResponse(handler.Get(), dnsIntReq,
+				getErrorResponse(dnsIntReq, layers.DNSResponseCodeRefused), maxTCPMessageSize))
+			writeMu.Unlock()
+			continue
+		}
+
+		go func(dnsIntReq layers.DNS) {
+			defer state.release()
+			dnsResponse := serveDNSPacket(handler, state, dnsIntReq, cache, transport, intConn.RemoteAddr().String())
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			intConn.SetWriteDeadline(time.Now().Add(idleTimeout))
+			writeTCPMessage(intConn, getClientResponse(handler.Get(), dnsIntReq, dnsResponse, maxTCPMessageSize))
+		}(dnsIntReq)
+	}
+}
+
+func getTCPIdleTimeout(config *ConfigInstance) time.Duration {
+	idleTimeout := config.TCPIdleTimeout * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+	return idleTimeout
+}
+
+// readTCPMessage reads one DNS message prefixed by its two-byte length.
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeTCPMessage writes one DNS message prefixed by its two-byte length in a
+// single write, so concurrent writers never interleave their frames.
+func writeTCPMessage(conn net.Conn, data []byte) error {
+	if len(data) > 65535 {
+		return errors.New("DNS message is too long for TCP framing")
+	}
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	_, err := conn.Write(frame)
+	return err
+}
+
+func openExternalTCPConn(dstServerIP string) (net.Conn, error) {
+	tcpExternal := getServerAddr(dstServerIP, "53")
+	extConn, err := net.DialTimeout("tcp", tcpExternal, time.Second*2)
+	if err != nil {
+		Warnf("Unable to establish TCP connection to External DNS server %s: %v", tcpExternal, err)
+		return nil, err
+	}
+	return extConn, nil
+}
+
+// resendOverTCPWait4Response repeats a query over TCP. It is used when an
+// upstream UDP reply comes back with the TC bit set.
+func resendOverTCPWait4Response(tap *dnstapTap, dstServerIP string, dnsIntReq layers.DNS) layers.DNS {
+
+	extConn, err := openExternalTCPConn(dstServerIP)
+	if err == nil {
+		defer extConn.Close()
+	} else {
+		return layers.DNS{}
+	}
+
+	queryTime := time.Now()
+	extConn.SetDeadline(queryTime.Add(time.Second * 2))
+	if err := writeTCPMessage(extConn, dnsIntReq.Contents); err != nil {
+		return layers.DNS{}
+	}
+	tapResolverQuery(tap, extConn, ProtocolTCP, dnsIntReq.Contents, queryTime)
+
+	data, err := readTCPMessage(extConn)
+	if err != nil {
+		Warnf("No answer from %s to %s over TCP: %v", dstServerIP, getQuestionText(dnsIntReq), err)
+		return layers.DNS{}
+	}
+	tapResolverResponse(tap, extConn, ProtocolTCP, dnsIntReq.Contents, queryTime, data)
+
+	dnsResponse, ok := decodeDNSPacket(data)
+	if !ok {
+		return layers.DNS{}
+	}
+	return dnsResponse
+}
@@ -0,0 +1,525 @@
+package server
+
+import (
+	. "godns/cache"
+	. "godns/config"
+	. "godns/logger"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+type validationStatus int
+
+const (
+	validationIndeterminate validationStatus = iota
+	validationInsecure
+	validationSecure
+	validationBogus
+)
+
+// The AD and CD header bits live in the Z field of gopacket's DNS layer.
+const (
+	dnsFlagAD = 0x2
+	dnsFlagCD = 0x1
+
+	maxTrustPointTTL = time.Hour
+)
+
+// A walk step tells what was found at one name on the way from the root down
+// to the name being validated.
+const (
+	zoneCut = iota
+	noZoneCut
+	noSuchName
+)
+
+// trustPoint is the deepest zone with a known DNSSEC status found so far. For
+// secure zones it holds the validated DNSKEY set.
+type trustPoint struct {
+	zone   string
+	status validationStatus
+	keys   []dnskeyRecord
+}
+
+type walkStep struct {
+	kind       int
+	point      trustPoint
+	expiration time.Time
+}
+
+type trustPointCache struct {
+	mu    sync.Mutex
+	steps map[string]walkStep
+}
+
+var trustPoints = &trustPointCache{steps: make(map[string]walkStep)}
+
+func (tp *trustPointCache) get(name string) (walkStep, bool) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	step, found := tp.steps[name]
+	if !found || time.Now().After(step.expiration) {
+		return walkStep{}, false
+	}
+	return step, true
+}
+
+func (tp *trustPointCache) put(name string, step walkStep, ttl uint32) {
+	expTime := time.Duration(ttl) * time.Second
+	if expTime > maxTrustPointTTL {
+		expTime = maxTrustPointTTL
+	}
+	step.expiration = time.Now().Add(expTime)
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.steps[name] = step
+}
+
+// flush forgets every validated key, e.g. after the trust anchors changed.
+func (tp *trustPointCache) flush() {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.steps = make(map[string]walkStep)
+}
+
+// signedRRset groups the records of one owner name and type together with the
+// RRSIGs covering them.
+type signedRRset struct {
+	name    string
+	rrType  layers.DNSType
+	records []layers.DNSResourceRecord
+	sigs    []rrsigRecord
+}
+
+func getSignedRRsets(records []layers.DNSResourceRecord) []*signedRRset {
+	var rrsets []*signedRRset
+	find := func(name string, rrType layers.DNSType) *signedRRset {
+		for _, rrset := range rrsets {
+			if rrset.name == name && rrset.rrType == rrType {
+				return rrset
+			}
+		}
+		rrset := &signedRRset{name: name, rrType: rrType}
+		rrsets = append(rrsets, rrset)
+		return rrset
+	}
+
+	for _, rr := range records {
+		if rr.Type == layers.DNSTypeOPT {
+			continue
+		}
+		name := canonicalName(string(rr.Name))
+		if rr.Type == dnsTypeRRSIG {
+			if sig, ok := parseRRSIG(rr); ok {
+				rrset := find(name, sig.typeCovered)
+				rrset.sigs = append(rrset.sigs, sig)
+			}
+			continue
+		}
+		rrset := find(name, rr.Type)
+		rrset.records = append(rrset.records, rr)
+	}
+
+	var complete []*signedRRset
+	for _, rrset := range rrsets {
+		if len(rrset.records) > 0 {
+			complete = append(complete, rrset)
+		}
+	}
+	return complete
+}
+
+// verifyRRset accepts the RRset if any of its signatures made by the zone of
+// the trust point checks out with one of the zone's keys.
+func verifyRRset(rrset *signedRRset, point trustPoint) bool {
+	now := time.Now()
+	for _, sig := range rrset.sigs {
+		if sig.signerName != point.zone {
+			continue
+		}
+		for _, key := range point.keys {
+			if key.keyTag() == sig.keyTag && verifyRRSIG(rrset.records, sig, key, now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getWildcardLabels returns the label count of the wildcard an RRset was
+// synthesized from, if the RRSIG shows it was.
+func getWildcardLabels(rrset *signedRRset) (int, bool) {
+	for _, sig := range rrset.sigs {
+		if int(sig.labels) < len(nameLabels(rrset.name)) {
+			return int(sig.labels), true
+		}
+	}
+	return 0, false
+}
+
+// lookupRecords resolves a question on behalf of the validator itself. The
+// answer goes through the cache but is not validated here.
+func lookupRecords(handler *ConfigHandler, state *serverState, cache *Cache, name string, qtype layers.DNSType) (layers.DNS, bool) {
+	var dnsIntReq layers.DNS = layers.DNS{
+		ID:     getRandomID(),
+		RD:     true,
+		OpCode: layers.DNSOpCodeQuery,
+
+		Questions: []layers.DNSQuestion{{
+			Name:  []byte(name),
+			Type:  qtype,
+			Class: layers.DNSClassIN,
+		}},
+		Additionals: []layers.DNSResourceRecord{getOPTRecord(getUDPPayloadSize(handler.Get()), 0, true)},
+	}
+	return lookupDNSPacket(handler, state, getRebuiltDNSPacket(dnsIntReq), cache, nil)
+}
+
+// getValidatedKeys fetches the DNSKEY set of a zone and accepts it if it is
+// signed by a key that one of the DS records points to. A zone whose DS
+// records all use unsupported algorithms is treated as insecure.
+func getValidatedKeys(handler *ConfigHandler, state *serverState, cache *Cache, zone string, dsSet []dsRecord) (trustPoint, uint32) {
+	var supported bool
+	for _, ds := range dsSet {
+		if isSupportedDigest(ds.digestType) && isSupportedAlgorithm(ds.algorithm) {
+			supported = true
+		}
+	}
+	if !supported {
+		return trustPoint{zone: zone, status: validationInsecure}, uint32(maxTrustPointTTL / time.Second)
+	}
+
+	dnsResponse, ok := lookupRecords(handler, state, cache, zone, dnsTypeDNSKEY)
+	if !ok {
+		return trustPoint{zone: zone, status: validationBogus}, 0
+	}
+
+	for _, rrset := range getSignedRRsets(dnsResponse.Answers) {
+		if rrset.name != zone || rrset.rrType != dnsTypeDNSKEY {
+			continue
+		}
+		var keys []dnskeyRecord
+		for _, rr := range rrset.records {
+			if key, ok := parseDNSKEY(rr); ok {
+				keys = append(keys, key)
+			}
+		}
+		for _, ds := range dsSet {
+			for _, key := range keys {
+				if !ds.matches(zone, key) {
+					continue
+				}
+				if verifyRRset(rrset, trustPoint{zone: zone, keys: []dnskeyRecord{key}}) {
+					return trustPoint{zone: zone, status: validationSecure, keys: keys}, MinTTL(rrset.records)
+				}
+			}
+		}
+	}
+	return trustPoint{zone: zone, status: validationBogus}, 0
+}
+
+func getRootTrustPoint(handler *ConfigHandler, state *serverState, cache *Cache) trustPoint {
+	if step, found := trustPoints.get(""); found {
+		return step.point
+	}
+
+	var dsSet []dsRecord
+	for _, anchor := range handler.Get().TrustAnchors {
+		owner, ds, err := parseTrustAnchor(anchor)
+		if err != nil || owner != "" {
+			Warnf("Skipping invalid root trust anchor %s: %v", anchor, err)
+			continue
+		}
+		dsSet = append(dsSet, ds)
+	}
+	if len(dsSet) == 0 {
+		Errorf("DNSSEC is enabled, but no root trust anchor is configured")
+	}
+
+	point, ttl := getValidatedKeys(handler, state, cache, "", dsSet)
+	if point.status != validationBogus {
+		trustPoints.put("", walkStep{kind: zoneCut, point: point}, ttl)
+	}
+	return point
+}
+
+// getWalkStep asks the parent zone for the DS records of a name. A signed DS
+// set makes the name a secure zone cut. Otherwise the signed denial tells
+// whether the name is an unsigned delegation, a name inside the parent zone,
+// or does not exist at all.
+func getWalkStep(handler *ConfigHandler, state *serverState, cache *Cache, parent trustPoint, name string) (walkStep, uint32) {
+	bogus := walkStep{kind: zoneCut, point: trustPoint{zone: name, status: validationBogus}}
+	insecure := walkStep{kind: zoneCut, point: trustPoint{zone: name, status: validationInsecure}}
+
+	dnsResponse, ok := lookupRecords(handler, state, cache, name, dnsTypeDS)
+	if !ok {
+		return bogus, 0
+	}
+
+	for _, rrset := range getSignedRRsets(dnsResponse.Answers) {
+		if rrset.name != name {
+			continue
+		}
+		if !verifyRRset(rrset, parent) {
+			return bogus, 0
+		}
+		switch rrset.rrType {
+		case dnsTypeDS:
+			var dsSet []dsRecord
+			for _, rr := range rrset.records {
+				if ds, ok := parseDS(rr); ok {
+					dsSet = append(dsSet, ds)
+				}
+			}
+			point, ttl := getValidatedKeys(handler, state, cache, name, dsSet)
+			if ttl > MinTTL(rrset.records) {
+				ttl = MinTTL(rrset.records)
+			}
+			return walkStep{kind: zoneCut, point: point}, ttl
+		case layers.DNSTypeCNAME:
+			return walkStep{kind: noSuchName, point: parent}, MinTTL(rrset.records)
+		}
+	}
+
+	if !isNegativeResponse(dnsResponse) {
+		return bogus, 0
+	}
+	nsecs, nsec3s, ok := getVerifiedDenial(dnsResponse.Authorities, parent)
+	if !ok {
+		return bogus, 0
+	}
+	ttl := MinTTL(dnsResponse.Authorities)
+
+	if dnsResponse.ResponseCode == layers.DNSResponseCodeNXDomain {
+		if nsecProvesNXDomain(nsecs, name) {
+			return walkStep{kind: noSuchName, point: parent}, ttl
+		}
+		if proven, optOut := nsec3ProvesNXDomain(nsec3s, name); proven {
+			if optOut {
+				return insecure, ttl
+			}
+			return walkStep{kind: noSuchName, point: parent}, ttl
+		}
+		return bogus, 0
+	}
+
+	for _, nsec := range nsecs {
+		if nsec.owner == name {
+			return getDelegationStep(nsec.types, parent, insecure, bogus), ttl
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3Matches(nsec3, name) {
+			return getDelegationStep(nsec3.types, parent, insecure, bogus), ttl
+		}
+	}
+	if nsecProvesNoData(nsecs, name, dnsTypeDS) {
+		return walkStep{kind: noZoneCut, point: parent}, ttl
+	}
+	if proven, optOut := nsec3ProvesNoData(nsec3s, name, dnsTypeDS); proven {
+		if optOut {
+			return insecure, ttl
+		}
+		return walkStep{kind: noZoneCut, point: parent}, ttl
+	}
+	return bogus, 0
+}
+
+// getDelegationStep reads the type bitmap of the denial record at the name:
+// NS without SOA marks a delegation, which is unsigned since DS is missing.
+func getDelegationStep(types map[layers.DNSType]bool, parent trustPoint, insecure, bogus walkStep) walkStep {
+	switch {
+	case types[dnsTypeDS]:
+		return bogus
+	case types[layers.DNSTypeNS] && !types[layers.DNSTypeSOA]:
+		return insecure
+	}
+	return walkStep{kind: noZoneCut, point: parent}
+}
+
+// getTrustPoint walks the chain of trust from the root anchor down to the
+// zone the name belongs to, one label at a time. Every step is remembered, so
+// repeated walks only cost a few map lookups.
+func getTrustPoint(handler *ConfigHandler, state *serverState, cache *Cache, name string) trustPoint {
+	point := getRootTrustPoint(handler, state, cache)
+	labels := nameLabels(name)
+
+	for i := len(labels) - 1; i >= 0 && point.status == validationSecure; i-- {
+		child := strings.Join(labels[i:], ".")
+		step, found := trustPoints.get(child)
+		if !found {
+			var ttl uint32
+			step, ttl = getWalkStep(handler, state, cache, point, child)
+			if step.point.status != validationBogus {
+				trustPoints.put(child, step, ttl)
+			}
+		}
+		if step.kind == zoneCut {
+			point = step.point
+		}
+		if step.kind == noSuchName {
+			break
+		}
+	}
+	return point
+}
+
+// getVerifiedDenial returns the NSEC and NSEC3 records of the authority
+// section, provided that all of them are signed by the zone.
+func getVerifiedDenial(authorities []layers.DNSResourceRecord, point trustPoint) ([]nsecRecord, []nsec3Record, bool) {
+	var nsecs []nsecRecord
+	var nsec3s []nsec3Record
+	for _, rrset := range getSignedRRsets(authorities) {
+		if rrset.rrType != dnsTypeNSEC && rrset.rrType != dnsTypeNSEC3 {
+			continue
+		}
+		if !verifyRRset(rrset, point) {
+			return nil, nil, false
+		}
+		for _, rr := range rrset.records {
+			if nsec, ok := parseNSEC(rr); ok {
+				nsecs = append(nsecs, nsec)
+			}
+			if nsec3, ok := parseNSEC3(rr); ok {
+				nsec3s = append(nsec3s, nsec3)
+			}
+		}
+	}
+	return nsecs, usableNSEC3(nsec3s, point.zone), len(nsecs) > 0 || len(nsec3s) > 0
+}
+
+// getSigningZone returns the name whose zone signs the RRset. DS records are
+// signed by the parent side of a zone cut.
+func getSigningZone(name string, rrType layers.DNSType) string {
+	if rrType == dnsTypeDS {
+		return parentName(name)
+	}
+	return name
+}
+
+func validateResponse(handler *ConfigHandler, state *serverState, cache *Cache, question layers.DNSQuestion, dnsResponse layers.DNS) validationStatus {
+	status := validationIndeterminate
+
+	if rrsets := getSignedRRsets(dnsResponse.Answers); len(rrsets) > 0 {
+		status = validationSecure
+		for _, rrset := range rrsets {
+			point := getTrustPoint(handler, state, cache, getSigningZone(rrset.name, rrset.rrType))
+			if point.status == validationBogus {
+				return validationBogus
+			}
+			if point.status != validationSecure {
+				status = validationInsecure
+				continue
+			}
+			if !verifyRRset(rrset, point) {
+				return validationBogus
+			}
+			if labels, ok := getWildcardLabels(rrset); ok && !isWildcardExpansionProven(dnsResponse.Authorities, point, rrset.name, labels) {
+				return validationBogus
+			}
+		}
+	}
+
+	// A CNAME chain may end in a name that does not exist or has no records
+	// of the type asked for, and that denial needs a proof of its own. An
+	// answer without the records counts as a denial whatever its authority
+	// section holds, so one stripped of its SOA and NSEC records can't pass
+	// for an unsigned answer.
+	target, found, _ := followCNAMEs(string(question.Name), question.Type, dnsResponse.Answers)
+	if found {
+		return status
+	}
+	if dnsResponse.ResponseCode != layers.DNSResponseCodeNoErr && dnsResponse.ResponseCode != layers.DNSResponseCodeNXDomain {
+		return status
+	}
+
+	denial := validateDenial(handler, state, cache, target, question.Type, dnsResponse)
+	if len(dnsResponse.Answers) == 0 {
+		return denial
+	}
+	switch {
+	case status == validationBogus || denial == validationBogus:
+		return validationBogus
+	case status == validationSecure && denial == validationSecure:
+		return validationSecure
+	}
+	return validationInsecure
+}
+
+// validateDenial checks the NSEC or NSEC3 proof that qname does not exist or
+// has no records of qtype.
+func validateDenial(handler *ConfigHandler, state *serverState, cache *Cache, qname string, qtype layers.DNSType, dnsResponse layers.DNS) validationStatus {
+	point := getTrustPoint(handler, state, cache, getSigningZone(qname, qtype))
+	if point.status != validationSecure {
+		return point.status
+	}
+	nsecs, nsec3s, ok := getVerifiedDenial(dnsResponse.Authorities, point)
+	if !ok {
+		return validationBogus
+	}
+
+	var proven, optOut bool
+	if dnsResponse.ResponseCode == layers.DNSResponseCodeNXDomain {
+		proven = nsecProvesNXDomain(nsecs, qname)
+		if !proven {
+			proven, optOut = nsec3ProvesNXDomain(nsec3s, qname)
+		}
+	} else {
+		proven = nsecProvesNoData(nsecs, qname, qtype)
+		if !proven {
+			proven, optOut = nsec3ProvesNoData(nsec3s, qname, qtype)
+		}
+	}
+
+	switch {
+	case !proven:
+		return validationBogus
+	case optOut:
+		return validationInsecure
+	}
+	return validationSecure
+}
+
+// isWildcardExpansionProven checks that the name an answer was synthesized
+// for does not exist by itself (RFC 4035 section 5.3.4, RFC 5155 section 8.8).
+func isWildcardExpansionProven(authorities []layers.DNSResourceRecord, point trustPoint, name string, wildcardLabels int) bool {
+	nsecs, nsec3s, ok := getVerifiedDenial(authorities, point)
+	if !ok {
+		return false
+	}
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			return true
+		}
+	}
+	labels := nameLabels(name)
+	nextCloser := strings.Join(labels[len(labels)-wildcardLabels-1:], ".")
+	for _, nsec3 := range nsec3s {
+		if nsec3Covers(nsec3, nextCloser) {
+			return true
+		}
+	}
+	return false
+}
+
+// getValidatedResponse sets the AD bit on secure answers for clients that
+// asked for DNSSEC data, and turns bogus answers into SERVFAIL.
+func getValidatedResponse(handler *ConfigHandler, state *serverState, cache *Cache, dnsIntReq layers.DNS, dnsResponse layers.DNS) layers.DNS {
+	question := dnsIntReq.Questions[0]
+
+	switch validateResponse(handler, state, cache, question, dnsResponse) {
+	case validationBogus:
+		Warnf("DNSSEC validation failed for %s %s", string(question.Name), getTypeName(question.Type))
+		return getErrorResponse(dnsIntReq, layers.DNSResponseCodeServFail)
+
+	case validationSecure:
+		if getEDNSOptions(dnsIntReq).do || dnsIntReq.Z&dnsFlagAD != 0 {
+			dnsResponse.Z |= dnsFlagAD
+		}
+	}
+	return dnsResponse
+}
@@ -0,0 +1,718 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	. "godns/cache"
+	. "godns/config"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// testDenial is how a signed test zone proves that names or types are
+// missing.
+type testDenial int
+
+const (
+	denialNSEC testDenial = iota
+	denialNSEC3
+	denialNSEC3OptOut
+)
+
+var testDenials = []struct {
+	name   string
+	denial testDenial
+}{
+	{"nsec", denialNSEC},
+	{"nsec3", denialNSEC3},
+	{"nsec3 opt-out", denialNSEC3OptOut},
+}
+
+var testNSEC3Salt = []byte{0xab, 0xcd}
+
+const testNSEC3Iterations = 2
+
+// testZone is a zone of the stand-in resolver. Signed zones have a single
+// ECDSA P-256 key that signs everything, unsigned zones have no key.
+type testZone struct {
+	origin  string
+	key     *ecdsa.PrivateKey
+	records []layers.DNSResourceRecord
+	denial  testDenial
+
+	// corrupt are the names whose A records have broken signatures,
+	// unproven those whose denials come without NSEC or NSEC3 records.
+	corrupt  map[string]bool
+	unproven map[string]bool
+}
+
+func newTestZone(t *testing.T, origin string, signed bool, denial testDenial) *testZone {
+	t.Helper()
+	zone := &testZone{
+		origin:   origin,
+		denial:   denial,
+		corrupt:  make(map[string]bool),
+		unproven: make(map[string]bool),
+	}
+	zone.add(layers.DNSResourceRecord{
+		Name:  []byte(origin),
+		Type:  layers.DNSTypeSOA,
+		Class: layers.DNSClassIN,
+		TTL:   3600,
+		SOA: layers.DNSSOA{
+			MName:   []byte("ns." + origin),
+			RName:   []byte("admin." + origin),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minimum: 300,
+		},
+	})
+	if !signed {
+		return zone
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone.key = key
+	zone.add(getTestDNSKEY(origin, key))
+	return zone
+}
+
+func getTestDNSKEY(origin string, key *ecdsa.PrivateKey) layers.DNSResourceRecord {
+	data := []byte{0x01, 0x01, 3, 13}
+	data = append(data, key.PublicKey.X.FillBytes(make([]byte, 32))...)
+	data = append(data, key.PublicKey.Y.FillBytes(make([]byte, 32))...)
+	return layers.DNSResourceRecord{
+		Name:  []byte(origin),
+		Type:  dnsTypeDNSKEY,
+		Class: layers.DNSClassIN,
+		TTL:   3600,
+		Data:  data,
+	}
+}
+
+func (zone *testZone) add(records ...layers.DNSResourceRecord) {
+	zone.records = append(zone.records, records...)
+}
+
+func (zone *testZone) addA(name string, ip string) {
+	zone.add(layers.DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  layers.DNSTypeA,
+		Class: layers.DNSClassIN,
+		TTL:   300,
+		IP:    net.ParseIP(ip).To4(),
+	})
+}
+
+// delegate adds a zone cut to child, signed with a DS record for the key of
+// child unless the child is unsigned.
+func (zone *testZone) delegate(child *testZone) {
+	zone.add(layers.DNSResourceRecord{
+		Name:  []byte(child.origin),
+		Type:  layers.DNSTypeNS,
+		Class: layers.DNSClassIN,
+		TTL:   3600,
+		NS:    []byte("ns." + child.origin),
+	})
+	if child.key != nil {
+		zone.add(getTestDS(child.origin, getTestDNSKEY(child.origin, child.key)))
+	}
+}
+
+func getTestDS(owner string, dnskey layers.DNSResourceRecord) layers.DNSResourceRecord {
+	key, _ := parseDNSKEY(dnskey)
+	digest := sha256.Sum256(append(appendName(nil, []byte(owner)), dnskey.Data...))
+	data := appendUint16(nil, key.keyTag())
+	data = append(data, 13, 2)
+	return layers.DNSResourceRecord{
+		Name:  []byte(owner),
+		Type:  dnsTypeDS,
+		Class: layers.DNSClassIN,
+		TTL:   3600,
+		Data:  append(data, digest[:]...),
+	}
+}
+
+func (zone *testZone) lookup(name string, rrType layers.DNSType) []layers.DNSResourceRecord {
+	var found []layers.DNSResourceRecord
+	for _, rr := range zone.records {
+		if string(rr.Name) == name && rr.Type == rrType {
+			found = append(found, rr)
+		}
+	}
+	return found
+}
+
+func (zone *testZone) getTypes(name string) []layers.DNSType {
+	var types []layers.DNSType
+	for _, rr := range zone.records {
+		if string(rr.Name) == name {
+			types = append(types, rr.Type)
+		}
+	}
+	return types
+}
+
+func (zone *testZone) exists(name string) bool {
+	return len(zone.getTypes(name)) > 0
+}
+
+// isUnsignedCut reports whether name is a delegation without a DS record.
+func (zone *testZone) isUnsignedCut(name string) bool {
+	return name != zone.origin && len(zone.lookup(name, layers.DNSTypeNS)) > 0 && len(zone.lookup(name, dnsTypeDS)) == 0
+}
+
+// getChainNames returns the names of the NSEC or NSEC3 chain in canonical
+// order. With opt-out, unsigned delegations are left out of the chain.
+func (zone *testZone) getChainNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, rr := range zone.records {
+		name := string(rr.Name)
+		if seen[name] || zone.denial == denialNSEC3OptOut && zone.isUnsignedCut(name) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return compareNames(names[i], names[j]) < 0
+	})
+	return names
+}
+
+func (zone *testZone) inChain(name string) bool {
+	for _, chained := range zone.getChainNames() {
+		if chained == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getBitmapTypes lists the types at name as its NSEC or NSEC3 record shows
+// them.
+func (zone *testZone) getBitmapTypes(name string) []layers.DNSType {
+	types := zone.getTypes(name)
+	if zone.denial == denialNSEC {
+		return append(types, dnsTypeRRSIG, dnsTypeNSEC)
+	}
+	if zone.isUnsignedCut(name) {
+		return types
+	}
+	return append(types, dnsTypeRRSIG)
+}
+
+func packTestTypeBitmap(types []layers.DNSType) []byte {
+	windows := make(map[int][]byte)
+	for _, rrType := range types {
+		window, bit := int(rrType>>8), int(rrType&0xFF)
+		bitmap := windows[window]
+		for len(bitmap) <= bit/8 {
+			bitmap = append(bitmap, 0)
+		}
+		bitmap[bit/8] |= 0x80 >> (bit % 8)
+		windows[window] = bitmap
+	}
+	var data []byte
+	for window := 0; window < 256; window++ {
+		if bitmap, found := windows[window]; found {
+			data = append(data, byte(window), byte(len(bitmap)))
+			data = append(data, bitmap...)
+		}
+	}
+	return data
+}
+
+func (zone *testZone) getNSEC(name string) layers.DNSResourceRecord {
+	names := zone.getChainNames()
+	next := names[0]
+	for i, chained := range names {
+		if chained == name && i+1 < len(names) {
+			next = names[i+1]
+		}
+	}
+	return layers.DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  dnsTypeNSEC,
+		Class: layers.DNSClassIN,
+		TTL:   300,
+		Data:  append(appendName(nil, []byte(next)), packTestTypeBitmap(zone.getBitmapTypes(name))...),
+	}
+}
+
+// getCoveringNSEC returns the NSEC record whose span the missing name falls
+// into.
+func (zone *testZone) getCoveringNSEC(name string) layers.DNSResourceRecord {
+	names := zone.getChainNames()
+	owner := names[len(names)-1]
+	for _, chained := range names {
+		if compareNames(chained, name) < 0 {
+			owner = chained
+		}
+	}
+	return zone.getNSEC(owner)
+}
+
+func getTestNSEC3Hash(name string) []byte {
+	digest := sha1.Sum(append(appendName(nil, []byte(name)), testNSEC3Salt...))
+	for i := 0; i < testNSEC3Iterations; i++ {
+		digest = sha1.Sum(append(digest[:], testNSEC3Salt...))
+	}
+	return digest[:]
+}
+
+// getNSEC3Hashes returns the hashes of the chain names in hash order.
+func (zone *testZone) getNSEC3Hashes() [][]byte {
+	var hashes [][]byte
+	for _, name := range zone.getChainNames() {
+		hashes = append(hashes, getTestNSEC3Hash(name))
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i], hashes[j]) < 0
+	})
+	return hashes
+}
+
+func (zone *testZone) getNSEC3(hash []byte) layers.DNSResourceRecord {
+	hashes := zone.getNSEC3Hashes()
+	next := hashes[0]
+	var types []layers.DNSType
+	for i, chained := range hashes {
+		if bytes.Equal(chained, hash) && i+1 < len(hashes) {
+			next = hashes[i+1]
+		}
+	}
+	for _, name := range zone.getChainNames() {
+		if bytes.Equal(getTestNSEC3Hash(name), hash) {
+			types = zone.getBitmapTypes(name)
+		}
+	}
+
+	var flags byte
+	if zone.denial == denialNSEC3OptOut {
+		flags = nsec3FlagOptOut
+	}
+	data := []byte{1, flags}
+	data = appendUint16(data, testNSEC3Iterations)
+	data = append(data, byte(len(testNSEC3Salt)))
+	data = append(data, testNSEC3Salt...)
+	data = append(data, byte(len(next)))
+	data = append(data, next...)
+	data = append(data, packTestTypeBitmap(types)...)
+	owner := strings.ToLower(base32HexNoPadding.EncodeToString(hash))
+	if zone.origin != "" {
+		owner += "." + zone.origin
+	}
+	return layers.DNSResourceRecord{
+		Name:  []byte(owner),
+		Type:  dnsTypeNSEC3,
+		Class: layers.DNSClassIN,
+		TTL:   300,
+		Data:  data,
+	}
+}
+
+// getCoveringNSEC3 returns the NSEC3 record whose span the hash of the missing
+// name falls into.
+func (zone *testZone) getCoveringNSEC3(name string) layers.DNSResourceRecord {
+	hashes := zone.getNSEC3Hashes()
+	hash := getTestNSEC3Hash(name)
+	owner := hashes[len(hashes)-1]
+	for _, chained := range hashes {
+		if bytes.Compare(chained, hash) < 0 {
+			owner = chained
+		}
+	}
+	return zone.getNSEC3(owner)
+}
+
+// getDenial returns the NSEC or NSEC3 records proving that name does not
+// exist, or that it has no records of the type asked for.
+func (zone *testZone) getDenial(name string) []layers.DNSResourceRecord {
+	if zone.denial == denialNSEC {
+		if zone.exists(name) {
+			return []layers.DNSResourceRecord{zone.getNSEC(name)}
+		}
+		encloser := parentName(name)
+		for !zone.exists(encloser) {
+			encloser = parentName(encloser)
+		}
+		return []layers.DNSResourceRecord{zone.getCoveringNSEC(name), zone.getCoveringNSEC(wildcardName(encloser))}
+	}
+
+	if zone.inChain(name) {
+		return []layers.DNSResourceRecord{zone.getNSEC3(getTestNSEC3Hash(name))}
+	}
+	nextCloser, encloser := name, parentName(name)
+	for !zone.inChain(encloser) {
+		nextCloser, encloser = encloser, parentName(encloser)
+	}
+	denial := []layers.DNSResourceRecord{
+		zone.getNSEC3(getTestNSEC3Hash(encloser)),
+		zone.getCoveringNSEC3(nextCloser),
+	}
+	if !zone.exists(name) {
+		denial = append(denial, zone.getCoveringNSEC3(wildcardName(encloser)))
+	}
+	return denial
+}
+
+// sign adds an RRSIG to records, which must be a single RRset, as RFC 4034
+// section 3.1.8.1 describes.
+func (zone *testZone) sign(records []layers.DNSResourceRecord) []layers.DNSResourceRecord {
+	if zone.key == nil || len(records) == 0 {
+		return records
+	}
+	owner := string(records[0].Name)
+	now := time.Now()
+	header := appendUint16(nil, uint16(records[0].Type))
+	header = append(header, 13, byte(len(nameLabels(owner))))
+	header = appendUint32(header, records[0].TTL)
+	header = appendUint32(header, uint32(now.Add(time.Hour).Unix()))
+	header = appendUint32(header, uint32(now.Add(-time.Hour).Unix()))
+	key, _ := parseDNSKEY(getTestDNSKEY(zone.origin, zone.key))
+	header = appendUint16(header, key.keyTag())
+	header = appendName(header, []byte(zone.origin))
+
+	var rdatas [][]byte
+	for i := range records {
+		rdatas = append(rdatas, appendRData(nil, &records[i]))
+	}
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i], rdatas[j]) < 0
+	})
+	signed := append([]byte(nil), header...)
+	for _, rdata := range rdatas {
+		signed = appendName(signed, []byte(owner))
+		signed = appendUint16(signed, uint16(records[0].Type))
+		signed = appendUint16(signed, uint16(layers.DNSClassIN))
+		signed = appendUint32(signed, records[0].TTL)
+		signed = appendUint16(signed, uint16(len(rdata)))
+		signed = append(signed, rdata...)
+	}
+
+	digest := sha256.Sum256(signed)
+	r, s, err := ecdsa.Sign(rand.Reader, zone.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	if zone.corrupt[owner] && records[0].Type == layers.DNSTypeA {
+		signature[0] ^= 0xFF
+	}
+
+	return append(append([]layers.DNSResourceRecord(nil), records...), layers.DNSResourceRecord{
+		Name:  []byte(owner),
+		Type:  dnsTypeRRSIG,
+		Class: layers.DNSClassIN,
+		TTL:   records[0].TTL,
+		Data:  append(header, signature...),
+	})
+}
+
+// respond answers a question the way an authoritative server of the zone
+// would.
+func (zone *testZone) respond(name string, qtype layers.DNSType) (layers.DNSResponseCode, []layers.DNSResourceRecord, []layers.DNSResourceRecord) {
+	if records := zone.lookup(name, qtype); len(records) > 0 {
+		return layers.DNSResponseCodeNoErr, zone.sign(records), nil
+	}
+
+	rcode := layers.DNSResponseCodeNoErr
+	if !zone.exists(name) {
+		rcode = layers.DNSResponseCodeNXDomain
+	}
+	authorities := zone.sign(zone.lookup(zone.origin, layers.DNSTypeSOA))
+	if zone.key == nil || zone.unproven[name] {
+		return rcode, nil, authorities
+	}
+	for _, rr := range zone.getDenial(name) {
+		authorities = append(authorities, zone.sign([]layers.DNSResourceRecord{rr})...)
+	}
+	return rcode, nil, authorities
+}
+
+// testChain is a tree of zones answering together, as a resolver that
+// already knows all of them would.
+type testChain []*testZone
+
+// respond answers from the deepest zone holding the name. DS records are
+// served by the parent side of a zone cut. The response is decoded from the
+// wire, as one from upstream would be.
+func (chain testChain) respond(name string, qtype layers.DNSType) layers.DNS {
+	var zone *testZone
+	for _, candidate := range chain {
+		if !isSubdomain(name, candidate.origin) || qtype == dnsTypeDS && name == candidate.origin && name != "" {
+			continue
+		}
+		if zone == nil || len(nameLabels(candidate.origin)) > len(nameLabels(zone.origin)) {
+			zone = candidate
+		}
+	}
+
+	dnsResponse := layers.DNS{
+		QR: true,
+		RA: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte(name), Type: qtype, Class: layers.DNSClassIN},
+		},
+	}
+	dnsResponse.ResponseCode, dnsResponse.Answers, dnsResponse.Authorities = zone.respond(name, qtype)
+	dnsResponse, _ = decodeDNSPacket(packDNSMessage(dnsResponse))
+	return dnsResponse
+}
+
+// seed caches the answer to a question along with the DS and DNSKEY records
+// of the name and all its ancestors, which is everything the validator looks
+// up to check it.
+func (chain testChain) seed(cache *Cache, name string, qtype layers.DNSType) {
+	cacheTestResponse(cache, chain.respond(name, qtype))
+	chain.seedKeys(cache, name)
+}
+
+// seedKeys caches the DS and DNSKEY records of the name and all its
+// ancestors.
+func (chain testChain) seedKeys(cache *Cache, name string) {
+	for ancestor := name; ; ancestor = parentName(ancestor) {
+		cacheTestResponse(cache, chain.respond(ancestor, dnsTypeDNSKEY))
+		if ancestor == "" {
+			return
+		}
+		cacheTestResponse(cache, chain.respond(ancestor, dnsTypeDS))
+	}
+}
+
+func cacheTestResponse(cache *Cache, dnsResponse layers.DNS) {
+	question := dnsResponse.Questions[0]
+	cacheResponse(cache, NewKey(question.Name, question.Type, question.Class), dnsResponse)
+}
+
+// startTestUpstream answers queries from the chain on a loopback UDP port,
+// after tamper has had its way with the answer, and puts the server in
+// forwarding mode with that port as its upstream.
+func startTestUpstream(t *testing.T, handler *ConfigHandler, state *serverState, chain testChain, tamper func(dnsResponse *layers.DNS)) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, maxTCPMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			query, ok := decodeDNSPacket(buffer[:n])
+			if !ok || len(query.Questions) != 1 {
+				continue
+			}
+			question := query.Questions[0]
+			dnsResponse := chain.respond(canonicalName(string(question.Name)), question.Type)
+			dnsResponse.ID = query.ID
+			tamper(&dnsResponse)
+			conn.WriteTo(packDNSMessage(dnsResponse), addr)
+		}
+	}()
+
+	config := *handler.Get()
+	config.Mode = forwardMode
+	config.Forward.Upstreams = []UpstreamConfig{{Address: conn.LocalAddr().String()}}
+	handler.Set(&config)
+	upstreams, err := newForwarder(config.Forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.upstreams = upstreams
+}
+
+// startTestChain sets up a validating server with a cache that knows this
+// tree, with the test and example.test zones denying names the given way:
+//
+//	.                   signed, the trust anchor
+//	test                signed
+//	example.test        signed, bad.example.test has a broken signature and
+//	                    forged.example.test an NXDOMAIN without proof
+//	wrongds.test        signed, but the DS in test is for another key
+//	nods.test           signed, but test denies its DS without proof
+//	unsigned.test       unsigned, no DS in test
+func startTestChain(t *testing.T, denial testDenial) (*ConfigHandler, *serverState, *Cache, testChain) {
+	root := newTestZone(t, "", true, denialNSEC)
+	tld := newTestZone(t, "test", true, denial)
+	example := newTestZone(t, "example.test", true, denial)
+	wrongDS := newTestZone(t, "wrongds.test", true, denialNSEC)
+	noDS := newTestZone(t, "nods.test", true, denialNSEC)
+	unsigned := newTestZone(t, "unsigned.test", false, denialNSEC)
+
+	root.delegate(tld)
+	tld.delegate(example)
+	tld.delegate(unsigned)
+	// The DS of wrongds.test is made from a key of another zone with the
+	// same name, and nods.test is delegated as if it was unsigned.
+	tld.delegate(newTestZone(t, "wrongds.test", true, denialNSEC))
+	tld.delegate(newTestZone(t, "nods.test", false, denialNSEC))
+	tld.unproven["nods.test"] = true
+
+	example.addA("www.example.test", "192.0.2.1")
+	example.addA("bad.example.test", "192.0.2.2")
+	example.corrupt["bad.example.test"] = true
+	example.unproven["forged.example.test"] = true
+	wrongDS.addA("www.wrongds.test", "192.0.2.3")
+	noDS.addA("www.nods.test", "192.0.2.4")
+	unsigned.addA("www.unsigned.test", "192.0.2.5")
+
+	anchor := root.lookup("", dnsTypeDNSKEY)[0]
+	ds, _ := parseDS(getTestDS("", anchor))
+	configPath := filepath.Join(t.TempDir(), "conf.yaml")
+	configData := fmt.Sprintf("dnssec: true\ntrust-anchors:\n  - \". %d 13 2 %X\"\n", ds.keyTag, ds.digest)
+	if err := os.WriteFile(configPath, []byte(configData), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler := NewConfigHandler(configPath, ctx)
+	state := &serverState{
+		upstreams:    &forwarder{},
+		prefetches:   &prefetcher{},
+		staleAnswers: &staleResolver{},
+	}
+
+	trustPoints.flush()
+	t.Cleanup(trustPoints.flush)
+	return handler, state, NewCache(0, time.Minute, ctx), testChain{root, tld, example, wrongDS, noDS, unsigned}
+}
+
+// resolveTestQuery asks for name with the DO bit set, as a client that wants
+// DNSSEC data would, with everything needed to answer it in the cache.
+func resolveTestQuery(t *testing.T, handler *ConfigHandler, state *serverState, cache *Cache, chain testChain, name string, qtype layers.DNSType) layers.DNS {
+	t.Helper()
+	chain.seed(cache, name, qtype)
+	return queryTestServer(t, handler, state, cache, name, qtype)
+}
+
+func queryTestServer(t *testing.T, handler *ConfigHandler, state *serverState, cache *Cache, name string, qtype layers.DNSType) layers.DNS {
+	t.Helper()
+	query, _ := decodeDNSPacket(packDNSMessage(layers.DNS{
+		ID: 1,
+		RD: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte(name), Type: qtype, Class: layers.DNSClassIN},
+		},
+		Additionals: []layers.DNSResourceRecord{getOPTRecord(defaultUDPPayloadSize, 0, true)},
+	}))
+	dnsResponse, ok := answerDNSPacket(handler, state, query, cache, accessFull, nil)
+	if !ok {
+		t.Fatalf("no answer for %s %v", name, qtype)
+	}
+	return dnsResponse
+}
+
+func checkTestResponse(t *testing.T, dnsResponse layers.DNS, rcode layers.DNSResponseCode, answers int, authenticated bool) {
+	t.Helper()
+	question := dnsResponse.Questions[0]
+	if dnsResponse.ResponseCode != rcode || len(withoutOPT(dnsResponse.Answers)) < answers {
+		t.Errorf("%s %v: got %v with %d answers, want %v with %d", question.Name, question.Type,
+			dnsResponse.ResponseCode, len(withoutOPT(dnsResponse.Answers)), rcode, answers)
+	}
+	if ad := dnsResponse.Z&dnsFlagAD != 0; ad != authenticated {
+		t.Errorf("%s %v: got AD %v, want %v", question.Name, question.Type, ad, authenticated)
+	}
+}
+func TestSecureAnswerIsAuthenticated(t *testing.T) {
+	for _, test := range testDenials {
+		t.Run(test.name, func(t *testing.T) {
+			handler, state, cache, chain := startTestChain(t, test.denial)
+			dnsResponse := resolveTestQuery(t, handler, state, cache, chain, "www.example.test", layers.DNSTypeA)
+			checkTestResponse(t, dnsResponse, layers.DNSResponseCodeNoErr, 1, true)
+		})
+	}
+}
+
+func TestBogusAnswerIsServFail(t *testing.T) {
+	for _, test := range []struct {
+		why  string
+		name string
+	}{
+		{"bad signature", "bad.example.test"},
+		{"wrong DS", "www.wrongds.test"},
+		{"DS denied without proof", "www.nods.test"},
+		{"NXDOMAIN without proof", "forged.example.test"},
+	} {
+		t.Run(test.why, func(t *testing.T) {
+			handler, state, cache, chain := startTestChain(t, denialNSEC)
+			dnsResponse := resolveTestQuery(t, handler, state, cache, chain, test.name, layers.DNSTypeA)
+			checkTestResponse(t, dnsResponse, layers.DNSResponseCodeServFail, 0, false)
+		})
+	}
+}
+
+func TestDenialIsAuthenticated(t *testing.T) {
+	for _, test := range testDenials {
+		t.Run(test.name, func(t *testing.T) {
+			handler, state, cache, chain := startTestChain(t, test.denial)
+
+			// An opt-out span only proves that no signed name is missing,
+			// so the NXDOMAIN stands but is not authenticated.
+			dnsResponse := resolveTestQuery(t, handler, state, cache, chain, "nosuch.example.test", layers.DNSTypeA)
+			checkTestResponse(t, dnsResponse, layers.DNSResponseCodeNXDomain, 0, test.denial != denialNSEC3OptOut)
+
+			dnsResponse = resolveTestQuery(t, handler, state, cache, chain, "www.example.test", layers.DNSTypeAAAA)
+			checkTestResponse(t, dnsResponse, layers.DNSResponseCodeNoErr, 0, true)
+			if len(dnsResponse.Answers) > 0 {
+				t.Errorf("got %d answers to a NODATA question", len(dnsResponse.Answers))
+			}
+		})
+	}
+}
+
+func TestStrippedDenialIsServFail(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		qtype layers.DNSType
+	}{
+		{"nosuch.example.test", layers.DNSTypeA},
+		{"www.example.test", layers.DNSTypeAAAA},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			handler, state, cache, chain := startTestChain(t, denialNSEC)
+			startTestUpstream(t, handler, state, chain, func(dnsResponse *layers.DNS) {
+				dnsResponse.Authorities = nil
+			})
+			chain.seedKeys(cache, test.name)
+
+			dnsResponse := queryTestServer(t, handler, state, cache, test.name, test.qtype)
+			checkTestResponse(t, dnsResponse, layers.DNSResponseCodeServFail, 0, false)
+		})
+	}
+}
+
+func TestInsecureDelegation(t *testing.T) {
+	for _, test := range testDenials {
+		t.Run(test.name, func(t *testing.T) {
+			handler, state, cache, chain := startTestChain(t, test.denial)
+			dnsResponse := resolveTestQuery(t, handler, state, cache, chain, "www.unsigned.test", layers.DNSTypeA)
+			checkTestResponse(t, dnsResponse, layers.DNSResponseCodeNoErr, 1, false)
+		})
+	}
+}
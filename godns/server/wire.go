@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Record types gopacket has no constants for.
+const (
+	dnsTypeDS     layers.DNSType = 43
+	dnsTypeRRSIG  layers.DNSType = 46
+	dnsTypeNSEC   layers.DNSType = 47
+	dnsTypeDNSKEY layers.DNSType = 48
+	dnsTypeNSEC3  layers.DNSType = 50
+	dnsTypeIXFR   layers.DNSType = 251
+	dnsTypeAXFR   layers.DNSType = 252
+	dnsTypeANY    layers.DNSType = 255
+)
+
+// packDNSMessage serializes a DNS message to wire format. Unlike gopacket's
+// SerializeTo it copes with every record type: records gopacket has no fields
+// for (RRSIG, DNSKEY, DS, CAA, HTTPS and the like) are written from their raw
+// RDATA. Section counts are always taken from the slices, and names are never
+// compressed.
+func packDNSMessage(dnsMessage layers.DNS) []byte {
+	data := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(data, dnsMessage.ID)
+	data[2] = byte(b2i(dnsMessage.QR)<<7 | int(dnsMessage.OpCode&0xF)<<3 |
+		b2i(dnsMessage.AA)<<2 | b2i(dnsMessage.TC)<<1 | b2i(dnsMessage.RD))
+	data[3] = byte(b2i(dnsMessage.RA)<<7 | int(dnsMessage.Z&0x7)<<4 | int(dnsMessage.ResponseCode&0xF))
+	binary.BigEndian.PutUint16(data[4:], uint16(len(dnsMessage.Questions)))
+	binary.BigEndian.PutUint16(data[6:], uint16(len(dnsMessage.Answers)))
+	binary.BigEndian.PutUint16(data[8:], uint16(len(dnsMessage.Authorities)))
+	binary.BigEndian.PutUint16(data[10:], uint16(len(dnsMessage.Additionals)))
+
+	for _, quest := range dnsMessage.Questions {
+		data = appendName(data, quest.Name)
+		data = appendUint16(data, uint16(quest.Type))
+		data = appendUint16(data, uint16(quest.Class))
+	}
+	for _, section := range [][]layers.DNSResourceRecord{dnsMessage.Answers, dnsMessage.Authorities, dnsMessage.Additionals} {
+		for i := range section {
+			data = appendRecord(data, &section[i])
+		}
+	}
+	return data
+}
+
+func appendRecord(data []byte, rr *layers.DNSResourceRecord) []byte {
+	data = appendName(data, rr.Name)
+	data = appendUint16(data, uint16(rr.Type))
+	data = appendUint16(data, uint16(rr.Class))
+	data = appendUint32(data, rr.TTL)
+
+	lengthOffset := len(data)
+	data = appendUint16(data, 0)
+	data = appendRData(data, rr)
+
+	binary.BigEndian.PutUint16(data[lengthOffset:], uint16(len(data)-lengthOffset-2))
+	return data
+}
+
+// appendRData writes the RDATA of a record. Types decoded by gopacket are
+// written from their fields, since their raw data may hold compression
+// pointers into the original packet; all other types are copied as is.
+func appendRData(data []byte, rr *layers.DNSResourceRecord) []byte {
+	switch rr.Type {
+	case layers.DNSTypeA:
+		data = append(data, rr.IP.To4()...)
+	case layers.DNSTypeAAAA:
+		data = append(data, rr.IP.To16()...)
+	case layers.DNSTypeNS:
+		data = appendName(data, rr.NS)
+	case layers.DNSTypeCNAME:
+		data = appendName(data, rr.CNAME)
+	case layers.DNSTypePTR:
+		data = appendName(data, rr.PTR)
+	case layers.DNSTypeSOA:
+		data = appendName(data, rr.SOA.MName)
+		data = appendName(data, rr.SOA.RName)
+		data = appendUint32(data, rr.SOA.Serial)
+		data = appendUint32(data, rr.SOA.Refresh)
+		data = appendUint32(data, rr.SOA.Retry)
+		data = appendUint32(data, rr.SOA.Expire)
+		data = appendUint32(data, rr.SOA.Minimum)
+	case layers.DNSTypeMX:
+		data = appendUint16(data, rr.MX.Preference)
+		data = appendName(data, rr.MX.Name)
+	case layers.DNSTypeTXT:
+		for _, txt := range rr.TXTs {
+			data = append(data, byte(len(txt)))
+			data = append(data, txt...)
+		}
+	case layers.DNSTypeSRV:
+		data = appendUint16(data, rr.SRV.Priority)
+		data = appendUint16(data, rr.SRV.Weight)
+		data = appendUint16(data, rr.SRV.Port)
+		data = appendName(data, rr.SRV.Name)
+	case layers.DNSTypeURI:
+		data = appendUint16(data, rr.URI.Priority)
+		data = appendUint16(data, rr.URI.Weight)
+		data = append(data, rr.URI.Target...)
+	case layers.DNSTypeOPT:
+		for _, opt := range rr.OPT {
+			data = appendUint16(data, uint16(opt.Code))
+			data = appendUint16(data, uint16(len(opt.Data)))
+			data = append(data, opt.Data...)
+		}
+	default:
+		data = append(data, rr.Data...)
+	}
+	return data
+}
+
+// appendName writes a domain name as a sequence of labels. An empty name or a
+// single dot stands for the root.
+func appendName(data []byte, name []byte) []byte {
+	trimmed := strings.TrimSuffix(string(name), ".")
+	if trimmed != "" {
+		for _, label := range strings.Split(trimmed, ".") {
+			data = append(data, byte(len(label)))
+			data = append(data, label...)
+		}
+	}
+	return append(data, 0)
+}
+
+func appendUint16(data []byte, value uint16) []byte {
+	return append(data, byte(value>>8), byte(value))
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	return append(data, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,621 @@
+package zones
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+const maxIncludeDepth = 8
+
+// Record types gopacket has no constants for.
+const (
+	dnsTypeCAA layers.DNSType = 257
+)
+
+// token is a word of a zone file entry. Quoted strings keep their quotes off
+// and are marked, so that TXT data can tell them from names.
+type token struct {
+	text   string
+	quoted bool
+}
+
+// entry is one logical line of a zone file, with parentheses joined.
+type entry struct {
+	tokens []token
+	indent bool
+	line   int
+}
+
+// parser keeps the state that carries over between entries: the origin, the
+// default TTL and the owner and TTL of the previous record.
+type parser struct {
+	origin     string
+	defaultTTL uint32
+	hasDefault bool
+	lastOwner  string
+	hasOwner   bool
+	lastTTL    uint32
+	hasLastTTL bool
+	records    []layers.DNSResourceRecord
+	files      []string
+	noInclude  bool
+}
+
+// Parse returns the records of master file data that was not read by the
+// parser itself, like a zone downloaded over HTTP. source names the data in
+// errors. With includes set, relative $INCLUDE paths are resolved against
+// source, which must then be a local path; otherwise data with an $INCLUDE
+// directive is rejected, so that a remote zone can't read local files.
+func Parse(data []byte, source string, origin string, includes bool) ([]layers.DNSResourceRecord, error) {
+	p := &parser{origin: canonicalName(origin), noInclude: !includes}
+	if err := p.parseData(source, data, 0); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// parseFile reads a master file as described in RFC 1035 section 5.1,
+// including the $ORIGIN, $INCLUDE and (RFC 2308) $TTL directives.
+func (p *parser) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return errors.New("too many nested $INCLUDE directives in " + path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	p.files = append(p.files, path)
+	return p.parseData(path, data, depth)
+}
+
+func (p *parser) parseData(path string, data []byte, depth int) error {
+	entries, err := splitEntries(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, e := range entries {
+		if err := p.parseEntry(path, e, depth); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, e.line, err)
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseEntry(path string, e entry, depth int) error {
+	tokens := e.tokens
+	if !e.indent && !tokens[0].quoted && strings.HasPrefix(tokens[0].text, "$") {
+		return p.parseDirective(path, tokens, depth)
+	}
+
+	owner := p.lastOwner
+	if !e.indent {
+		var err error
+		if owner, err = parseName(tokens[0].text, p.origin); err != nil {
+			return err
+		}
+		tokens = tokens[1:]
+	}
+	if e.indent && !p.hasOwner {
+		return errors.New("record without owner name")
+	}
+	p.lastOwner, p.hasOwner = owner, true
+
+	var ttl uint32
+	var hasTTL bool
+	for len(tokens) > 0 {
+		if value, ok := parseTTL(tokens[0].text); ok && !hasTTL {
+			ttl, hasTTL = value, true
+		} else if isClass(tokens[0].text) {
+			if !strings.EqualFold(tokens[0].text, "IN") {
+				return errors.New("only class IN is supported")
+			}
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return errors.New("record without type")
+	}
+
+	switch {
+	case hasTTL:
+	case p.hasDefault:
+		ttl = p.defaultTTL
+	case p.hasLastTTL:
+		ttl = p.lastTTL
+	default:
+		return errors.New("record without TTL and no $TTL set")
+	}
+	p.lastTTL, p.hasLastTTL = ttl, true
+
+	rrType, ok := parseType(tokens[0].text)
+	if !ok {
+		return errors.New("unknown record type " + tokens[0].text)
+	}
+	rr := layers.DNSResourceRecord{
+		Name:  []byte(owner),
+		Type:  rrType,
+		Class: layers.DNSClassIN,
+		TTL:   ttl,
+	}
+	if err := p.parseRData(&rr, tokens[1:]); err != nil {
+		return err
+	}
+	p.records = append(p.records, rr)
+	return nil
+}
+
+func (p *parser) parseDirective(path string, tokens []token, depth int) error {
+	switch strings.ToUpper(tokens[0].text) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return errors.New("$ORIGIN needs one domain name")
+		}
+		origin, err := parseName(tokens[1].text, p.origin)
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+
+	case "$TTL":
+		if len(tokens) != 2 {
+			return errors.New("$TTL needs one value")
+		}
+		ttl, ok := parseTTL(tokens[1].text)
+		if !ok {
+			return errors.New("bad $TTL value " + tokens[1].text)
+		}
+		p.defaultTTL, p.hasDefault = ttl, true
+
+	case "$INCLUDE":
+		if p.noInclude {
+			return errors.New("$INCLUDE is not allowed in " + path)
+		}
+		if len(tokens) < 2 || len(tokens) > 3 {
+			return errors.New("$INCLUDE needs a file name and an optional origin")
+		}
+		includePath := tokens[1].text
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), includePath)
+		}
+		// The included file may change the origin and the owner, but both
+		// are restored afterwards (RFC 1035 section 5.1).
+		origin, owner := p.origin, p.lastOwner
+		if len(tokens) == 3 {
+			includeOrigin, err := parseName(tokens[2].text, p.origin)
+			if err != nil {
+				return err
+			}
+			p.origin = includeOrigin
+		}
+		err := p.parseFile(includePath, depth+1)
+		p.origin, p.lastOwner = origin, owner
+		return err
+
+	default:
+		return errors.New("unknown directive " + tokens[0].text)
+	}
+	return nil
+}
+
+func (p *parser) parseRData(rr *layers.DNSResourceRecord, tokens []token) error {
+	if len(tokens) > 0 && tokens[0].text == `\#` && !tokens[0].quoted {
+		return parseGenericRData(rr, tokens[1:])
+	}
+
+	fields := make([]string, len(tokens))
+	for i, t := range tokens {
+		fields[i] = t.text
+	}
+	want := func(n int) error {
+		if len(fields) != n {
+			return fmt.Errorf("%s record needs %d fields, got %d", rr.Type, n, len(fields))
+		}
+		return nil
+	}
+
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		if err := want(1); err != nil {
+			return err
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || (rr.Type == layers.DNSTypeA) != (ip.To4() != nil) {
+			return errors.New("bad address " + fields[0])
+		}
+		rr.IP = ip
+
+	case layers.DNSTypeNS, layers.DNSTypeCNAME, layers.DNSTypePTR:
+		if err := want(1); err != nil {
+			return err
+		}
+		target, err := parseName(fields[0], p.origin)
+		if err != nil {
+			return err
+		}
+		name := []byte(target)
+		switch rr.Type {
+		case layers.DNSTypeNS:
+			rr.NS = name
+		case layers.DNSTypeCNAME:
+			rr.CNAME = name
+		default:
+			rr.PTR = name
+		}
+
+	case layers.DNSTypeMX:
+		if err := want(2); err != nil {
+			return err
+		}
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return err
+		}
+		exchange, err := parseName(fields[1], p.origin)
+		if err != nil {
+			return err
+		}
+		rr.MX = layers.DNSMX{Preference: uint16(preference), Name: []byte(exchange)}
+
+	case layers.DNSTypeTXT:
+		if len(tokens) == 0 {
+			return errors.New("TXT record needs at least one string")
+		}
+		for _, t := range tokens {
+			if len(t.text) > 255 {
+				return errors.New("TXT string longer than 255 characters")
+			}
+			rr.TXTs = append(rr.TXTs, []byte(t.text))
+		}
+
+	case layers.DNSTypeSOA:
+		if err := want(7); err != nil {
+			return err
+		}
+		var values [5]uint32
+		for i := range values {
+			value, ok := parseTTL(fields[2+i])
+			if !ok {
+				return errors.New("bad SOA value " + fields[2+i])
+			}
+			values[i] = value
+		}
+		mname, err := parseName(fields[0], p.origin)
+		if err != nil {
+			return err
+		}
+		rname, err := parseName(fields[1], p.origin)
+		if err != nil {
+			return err
+		}
+		rr.SOA = layers.DNSSOA{
+			MName:   []byte(mname),
+			RName:   []byte(rname),
+			Serial:  values[0],
+			Refresh: values[1],
+			Retry:   values[2],
+			Expire:  values[3],
+			Minimum: values[4],
+		}
+
+	case layers.DNSTypeSRV:
+		if err := want(4); err != nil {
+			return err
+		}
+		var values [3]uint16
+		for i := range values {
+			value, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return err
+			}
+			values[i] = uint16(value)
+		}
+		target, err := parseName(fields[3], p.origin)
+		if err != nil {
+			return err
+		}
+		rr.SRV = layers.DNSSRV{
+			Priority: values[0],
+			Weight:   values[1],
+			Port:     values[2],
+			Name:     []byte(target),
+		}
+
+	case dnsTypeCAA:
+		if err := want(3); err != nil {
+			return err
+		}
+		flags, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return err
+		}
+		rr.Data = append([]byte{byte(flags), byte(len(fields[1]))}, fields[1]...)
+		rr.Data = append(rr.Data, fields[2]...)
+
+	default:
+		return fmt.Errorf("%s records must use the \\# syntax of RFC 3597", rr.Type)
+	}
+	return nil
+}
+
+// parseGenericRData reads the RFC 3597 form: \# length hex-data.
+func parseGenericRData(rr *layers.DNSResourceRecord, tokens []token) error {
+	if len(tokens) == 0 {
+		return errors.New(`\# needs the data length`)
+	}
+	length, err := strconv.Atoi(tokens[0].text)
+	if err != nil {
+		return err
+	}
+	var hexData strings.Builder
+	for _, t := range tokens[1:] {
+		hexData.WriteString(t.text)
+	}
+	data, err := hex.DecodeString(hexData.String())
+	if err != nil {
+		return err
+	}
+	if len(data) != length {
+		return fmt.Errorf("\\# length %d does not match %d bytes of data", length, len(data))
+	}
+	rr.Data = data
+	return nil
+}
+
+// splitEntries breaks the file into entries, dropping comments and joining
+// lines inside parentheses.
+func splitEntries(data string) ([]entry, error) {
+	var entries []entry
+	var current entry
+	var word strings.Builder
+	var inWord, inQuotes bool
+	depth, line := 0, 1
+	current.line = line
+	atLineStart := true
+
+	endWord := func(quoted bool) {
+		if inWord || quoted {
+			current.tokens = append(current.tokens, token{text: word.String(), quoted: quoted})
+		}
+		word.Reset()
+		inWord = false
+	}
+	endEntry := func() {
+		if len(current.tokens) > 0 {
+			entries = append(entries, current)
+		}
+		current = entry{line: line}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+
+		if inQuotes {
+			switch c {
+			case '"':
+				inQuotes = false
+				endWord(true)
+			case '\\':
+				if i+1 < len(data) {
+					i++
+					word.WriteByte(data[i])
+				}
+			case '\n':
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			default:
+				word.WriteByte(c)
+			}
+			continue
+		}
+
+		switch c {
+		case ';':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			i--
+		case '"':
+			endWord(false)
+			inQuotes = true
+		case '(':
+			endWord(false)
+			depth++
+		case ')':
+			endWord(false)
+			if depth == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parentheses", line)
+			}
+			depth--
+		case ' ', '\t', '\r':
+			if atLineStart && len(current.tokens) == 0 && depth == 0 {
+				current.indent = true
+			}
+			endWord(false)
+		case '\n':
+			endWord(false)
+			line++
+			if depth == 0 {
+				endEntry()
+				atLineStart = true
+				continue
+			}
+		case '\\':
+			word.WriteByte(c)
+			if i+1 < len(data) {
+				i++
+				word.WriteByte(data[i])
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+		atLineStart = false
+	}
+	if inQuotes {
+		return nil, errors.New("unterminated string")
+	}
+	if depth != 0 {
+		return nil, errors.New("unbalanced parentheses")
+	}
+	endWord(false)
+	endEntry()
+	return entries, nil
+}
+
+// parseName turns a name from the zone file into an absolute name without
+// the trailing dot. "@" stands for the origin, and names without a trailing
+// dot are relative to it. The escapes \X and \DDD of RFC 1035 section 5.1
+// are decoded, but names are kept in dotted form, so a label can't hold a dot.
+func parseName(text string, origin string) (string, error) {
+	if text == "@" {
+		return origin, nil
+	}
+	if text == "." {
+		return "", nil
+	}
+
+	var labels []string
+	var label strings.Builder
+	absolute := false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case '.':
+			if label.Len() == 0 {
+				return "", errors.New("empty label in " + text)
+			}
+			labels = append(labels, label.String())
+			label.Reset()
+			absolute = i == len(text)-1
+			continue
+		case '\\':
+			if i+1 == len(text) {
+				return "", errors.New("name ends with a backslash: " + text)
+			}
+			c = text[i+1]
+			i++
+			if c >= '0' && c <= '9' {
+				if i+3 > len(text) {
+					return "", errors.New("bad \\DDD escape in " + text)
+				}
+				value, err := strconv.ParseUint(text[i:i+3], 10, 8)
+				if err != nil {
+					return "", errors.New("bad \\DDD escape in " + text)
+				}
+				c = byte(value)
+				i += 2
+			}
+			if c == '.' {
+				return "", errors.New("labels with a dot are not supported: " + text)
+			}
+		}
+		label.WriteByte(c)
+		if label.Len() > 63 {
+			return "", errors.New("label longer than 63 characters in " + text)
+		}
+	}
+	if label.Len() > 0 {
+		labels = append(labels, label.String())
+	}
+
+	name := strings.Join(labels, ".")
+	if !absolute && origin != "" {
+		name += "." + origin
+	}
+	return name, nil
+}
+
+// parseTTL reads a TTL in seconds or with BIND style units like 1h30m.
+func parseTTL(text string) (uint32, bool) {
+	if text == "" {
+		return 0, false
+	}
+	if value, err := strconv.ParseUint(text, 10, 32); err == nil {
+		return uint32(value), true
+	}
+
+	var total, number uint64
+	var hasNumber bool
+	for _, c := range strings.ToLower(text) {
+		if c >= '0' && c <= '9' {
+			number = number*10 + uint64(c-'0')
+			hasNumber = true
+			continue
+		}
+		var unit uint64
+		switch c {
+		case 's':
+			unit = 1
+		case 'm':
+			unit = 60
+		case 'h':
+			unit = 3600
+		case 'd':
+			unit = 86400
+		case 'w':
+			unit = 604800
+		default:
+			return 0, false
+		}
+		if !hasNumber {
+			return 0, false
+		}
+		total += number * unit
+		number, hasNumber = 0, false
+	}
+	if hasNumber || total > 0xFFFFFFFF {
+		return 0, false
+	}
+	return uint32(total), true
+}
+
+func isClass(text string) bool {
+	switch strings.ToUpper(text) {
+	case "IN", "CH", "HS", "CS":
+		return true
+	}
+	return false
+}
+
+var typeNames = map[string]layers.DNSType{
+	"A":     layers.DNSTypeA,
+	"NS":    layers.DNSTypeNS,
+	"CNAME": layers.DNSTypeCNAME,
+	"SOA":   layers.DNSTypeSOA,
+	"PTR":   layers.DNSTypePTR,
+	"MX":    layers.DNSTypeMX,
+	"TXT":   layers.DNSTypeTXT,
+	"AAAA":  layers.DNSTypeAAAA,
+	"SRV":   layers.DNSTypeSRV,
+	"DS":    43,
+	"SSHFP": 44,
+	"TLSA":  52,
+	"SVCB":  64,
+	"HTTPS": 65,
+	"CAA":   dnsTypeCAA,
+}
+
+// parseType reads a type mnemonic or the TYPEnnn form of RFC 3597.
+func parseType(text string) (layers.DNSType, bool) {
+	upper := strings.ToUpper(text)
+	if rrType, found := typeNames[upper]; found {
+		return rrType, true
+	}
+	if strings.HasPrefix(upper, "TYPE") {
+		value, err := strconv.ParseUint(upper[4:], 10, 16)
+		if err == nil {
+			return layers.DNSType(value), true
+		}
+	}
+	return 0, false
+}
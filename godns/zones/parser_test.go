@@ -0,0 +1,265 @@
+package zones
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// writeTestFiles writes files into a new directory and returns its path.
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// formatRecord prints a record as owner, TTL, type and the data the tests
+// look at.
+func formatRecord(rr layers.DNSResourceRecord) string {
+	var data string
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		data = rr.IP.String()
+	case layers.DNSTypeNS:
+		data = string(rr.NS)
+	case layers.DNSTypeCNAME:
+		data = string(rr.CNAME)
+	case layers.DNSTypeMX:
+		data = fmt.Sprintf("%d %s", rr.MX.Preference, rr.MX.Name)
+	case layers.DNSTypeSOA:
+		data = fmt.Sprintf("%s %s %d %d", rr.SOA.MName, rr.SOA.RName, rr.SOA.Serial, rr.SOA.Minimum)
+	case layers.DNSTypeTXT:
+		var texts []string
+		for _, txt := range rr.TXTs {
+			texts = append(texts, fmt.Sprintf("%q", txt))
+		}
+		data = strings.Join(texts, " ")
+	}
+	return fmt.Sprintf("%s %d %v %s", rr.Name, rr.TTL, rr.Type, data)
+}
+
+func TestParseFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+		err   string
+	}{{
+		name: "relative and absolute owners",
+		files: map[string]string{"zone": "www 300 A 192.0.2.1\n" +
+			"mail.example.org. 300 A 192.0.2.2\n" +
+			"@ 300 NS ns\n" +
+			". 300 NS ns.example.org.\n"},
+		want: []string{
+			"www.example.test 300 A 192.0.2.1",
+			"mail.example.org 300 A 192.0.2.2",
+			"example.test 300 NS ns.example.test",
+			" 300 NS ns.example.org",
+		},
+	}, {
+		name: "owner of the previous record",
+		files: map[string]string{"zone": "www 300 A 192.0.2.1\n" +
+			"    300 AAAA 2001:db8::1\n" +
+			"\tMX 10 mail\n"},
+		want: []string{
+			"www.example.test 300 A 192.0.2.1",
+			"www.example.test 300 AAAA 2001:db8::1",
+			"www.example.test 300 MX 10 mail.example.test",
+		},
+	}, {
+		name: "$ORIGIN",
+		files: map[string]string{"zone": "$ORIGIN sub.example.test.\n" +
+			"www 300 A 192.0.2.1\n" +
+			"$ORIGIN deeper\n" +
+			"www 300 A 192.0.2.2\n" +
+			"$ORIGIN .\n" +
+			"top 300 A 192.0.2.3\n"},
+		want: []string{
+			"www.sub.example.test 300 A 192.0.2.1",
+			"www.deeper.sub.example.test 300 A 192.0.2.2",
+			"top 300 A 192.0.2.3",
+		},
+	}, {
+		name: "$TTL",
+		files: map[string]string{"zone": "a 60 A 192.0.2.1\n" +
+			"b A 192.0.2.2\n" +
+			"$TTL 1h30m\n" +
+			"c A 192.0.2.3\n" +
+			"d 1W A 192.0.2.4\n" +
+			"e IN A 192.0.2.5\n"},
+		want: []string{
+			"a.example.test 60 A 192.0.2.1",
+			"b.example.test 60 A 192.0.2.2",
+			"c.example.test 5400 A 192.0.2.3",
+			"d.example.test 604800 A 192.0.2.4",
+			"e.example.test 5400 A 192.0.2.5",
+		},
+	}, {
+		name:  "no TTL",
+		files: map[string]string{"zone": "www A 192.0.2.1\n"},
+		err:   "record without TTL and no $TTL set",
+	}, {
+		name:  "bad $TTL",
+		files: map[string]string{"zone": "$TTL soon\n"},
+		err:   "bad $TTL value soon",
+	}, {
+		name: "parentheses and comments",
+		files: map[string]string{"zone": "@ 3600 SOA ns hostmaster ( ; primary and mailbox\n" +
+			"        2024010101 ; serial\n" +
+			"        1h 15m 1w\n" +
+			"        300 )\n" +
+			"txt 300 TXT ( \"one\" ; first\n" +
+			"        \"two ; not a comment\" )\n"},
+		want: []string{
+			"example.test 3600 SOA ns.example.test hostmaster.example.test 2024010101 300",
+			`txt.example.test 300 TXT "one" "two ; not a comment"`,
+		},
+	}, {
+		name:  "unbalanced parentheses",
+		files: map[string]string{"zone": "@ 3600 SOA ns hostmaster ( 1 2 3 4 5\n"},
+		err:   "unbalanced parentheses",
+	}, {
+		name: "$INCLUDE",
+		files: map[string]string{
+			"zone": "www 300 A 192.0.2.1\n" +
+				"$INCLUDE hosts\n" +
+				"    300 A 192.0.2.2\n" +
+				"$INCLUDE hosts other.test.\n" +
+				"next 300 A 192.0.2.3\n",
+			"hosts": "$ORIGIN inner\n" + "host 300 A 192.0.2.9\n",
+		},
+		want: []string{
+			"www.example.test 300 A 192.0.2.1",
+			"host.inner.example.test 300 A 192.0.2.9",
+			"www.example.test 300 A 192.0.2.2",
+			"host.inner.other.test 300 A 192.0.2.9",
+			"next.example.test 300 A 192.0.2.3",
+		},
+	}, {
+		name:  "missing $INCLUDE file",
+		files: map[string]string{"zone": "$INCLUDE missing\n"},
+		err:   "no such file",
+	}, {
+		name:  "$INCLUDE nested too deep",
+		files: map[string]string{"zone": "$INCLUDE zone\n"},
+		err:   "too many nested $INCLUDE directives",
+	}, {
+		name: "escapes",
+		files: map[string]string{"zone": `a\032b 300 A 192.0.2.1` + "\n" +
+			`\065bc 300 A 192.0.2.2` + "\n" +
+			`x\\y.example.org. 300 A 192.0.2.3` + "\n" +
+			`semi\;colon 300 CNAME t\(arget\)` + "\n" +
+			`\@ 300 A 192.0.2.4` + "\n" +
+			`txt 300 TXT "say \"hi\"" "back\\slash"` + "\n"},
+		want: []string{
+			"a b.example.test 300 A 192.0.2.1",
+			"Abc.example.test 300 A 192.0.2.2",
+			`x\y.example.org 300 A 192.0.2.3`,
+			"semi;colon.example.test 300 CNAME t(arget).example.test",
+			"@.example.test 300 A 192.0.2.4",
+			`txt.example.test 300 TXT "say \"hi\"" "back\\slash"`,
+		},
+	}, {
+		name:  "escaped dot",
+		files: map[string]string{"zone": `@ 300 SOA ns host\.master 1 2 3 4 5` + "\n"},
+		err:   "labels with a dot are not supported",
+	}, {
+		name:  "escaped dot in decimal",
+		files: map[string]string{"zone": `a\046b 300 A 192.0.2.1` + "\n"},
+		err:   "labels with a dot are not supported",
+	}, {
+		name:  "escape out of range",
+		files: map[string]string{"zone": `a\256 300 A 192.0.2.1` + "\n"},
+		err:   `bad \DDD escape`,
+	}, {
+		name:  "short decimal escape",
+		files: map[string]string{"zone": `a\12 300 A 192.0.2.1` + "\n"},
+		err:   `bad \DDD escape`,
+	}, {
+		name:  "empty label",
+		files: map[string]string{"zone": "a..b 300 A 192.0.2.1\n"},
+		err:   "empty label",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeTestFiles(t, test.files)
+			p := &parser{origin: "example.test"}
+			err := p.parseFile(filepath.Join(dir, "zone"), 0)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, rr := range p.records {
+				got = append(got, formatRecord(rr))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got records\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseFileListsIncludedFiles(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"zone":  "$INCLUDE sub/hosts\n",
+		"other": "other 300 A 192.0.2.2\n",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	// Relative paths are resolved against the directory of the file that
+	// includes them.
+	hosts := filepath.Join(dir, "sub", "hosts")
+	if err := os.WriteFile(hosts, []byte("$INCLUDE ../other\nhost 300 A 192.0.2.1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &parser{origin: "example.test"}
+	if err := p.parseFile(filepath.Join(dir, "zone"), 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "zone"), hosts, filepath.Join(dir, "sub", "..", "other")}
+	for i := range want {
+		want[i] = filepath.Clean(want[i])
+	}
+	var got []string
+	for _, path := range p.files {
+		got = append(got, filepath.Clean(path))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %v, want %v", got, want)
+	}
+}
+
+func TestParseRefusesIncludeUnlessAllowed(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"secret": "leak 300 A 192.0.2.1\n"})
+	source := filepath.Join(dir, "policy.rpz")
+	data := []byte("$INCLUDE secret\n")
+
+	if _, err := Parse(data, "https://example.com/policy.rpz", "rpz.test", false); err == nil {
+		t.Error("a zone that wasn't read from a local file followed $INCLUDE")
+	}
+	records, err := Parse(data, source, "rpz.test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || string(records[0].Name) != "leak.rpz.test" {
+		t.Errorf("the included record wasn't read from a local zone: %v", records)
+	}
+}
@@ -0,0 +1,153 @@
+package zones
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Zone is the data of one zone loaded from a master file. Names are kept
+// lowercase and without the trailing dot.
+type Zone struct {
+	Origin string
+	Files  []string
+
+	records map[string][]layers.DNSResourceRecord
+	names   map[string]bool
+	soa     layers.DNSResourceRecord
+}
+
+// Load parses the zone file at path with origin as the initial $ORIGIN. The
+// zone must have exactly one SOA record at its apex, and every record must
+// belong to the zone.
+func Load(path string, origin string) (*Zone, error) {
+	origin = canonicalName(origin)
+	p := &parser{origin: origin}
+	if err := p.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+
+	zone := &Zone{
+		Origin:  origin,
+		Files:   p.files,
+		records: make(map[string][]layers.DNSResourceRecord),
+		names:   make(map[string]bool),
+	}
+	var soaCount int
+	for _, rr := range p.records {
+		owner := canonicalName(string(rr.Name))
+		if !isSubdomain(owner, origin) {
+			return nil, errors.New(owner + " is outside of zone " + origin)
+		}
+		if rr.Type == layers.DNSTypeSOA {
+			if owner != origin {
+				return nil, errors.New("SOA record of " + owner + " is not at the zone apex")
+			}
+			zone.soa = rr
+			soaCount++
+		}
+		zone.records[owner] = append(zone.records[owner], rr)
+
+		// Every ancestor up to the apex exists, even without records of
+		// its own (an empty non-terminal).
+		for name := owner; name != origin; name = parentName(name) {
+			zone.names[name] = true
+		}
+		zone.names[origin] = true
+	}
+	if soaCount != 1 {
+		return nil, errors.New("zone " + origin + " must have exactly one SOA record")
+	}
+	return zone, nil
+}
+
+// Records returns the records owned by name, of any type.
+func (zone *Zone) Records(name string) []layers.DNSResourceRecord {
+	return zone.records[canonicalName(name)]
+}
+
+// Exists reports whether name is in the zone, either with records or as an
+// empty non-terminal.
+func (zone *Zone) Exists(name string) bool {
+	return zone.names[canonicalName(name)]
+}
+
+// Lookup returns the records for name. Names that do not exist are answered
+// from a matching wildcard (RFC 4592) with the owner replaced by name. The
+// second result is false when neither the name nor a wildcard exists.
+func (zone *Zone) Lookup(name string) ([]layers.DNSResourceRecord, bool) {
+	name = canonicalName(name)
+	if zone.Exists(name) {
+		return zone.records[name], true
+	}
+
+	encloser := parentName(name)
+	for !zone.Exists(encloser) && encloser != zone.Origin && encloser != "" {
+		encloser = parentName(encloser)
+	}
+	wildcard, found := zone.records[joinName("*", encloser)]
+	if !found {
+		return nil, false
+	}
+	synthesized := make([]layers.DNSResourceRecord, len(wildcard))
+	for i, rr := range wildcard {
+		rr.Name = []byte(name)
+		synthesized[i] = rr
+	}
+	return synthesized, true
+}
+
+// Delegation returns the name of the closest zone cut at or above name, below
+// the apex, or an empty string when name is not delegated.
+func (zone *Zone) Delegation(name string) string {
+	name = canonicalName(name)
+	var cut string
+	for current := name; current != zone.Origin && isSubdomain(current, zone.Origin); current = parentName(current) {
+		for _, rr := range zone.records[current] {
+			if rr.Type == layers.DNSTypeNS {
+				cut = current
+				break
+			}
+		}
+	}
+	return cut
+}
+
+// SOA returns the SOA record of the zone with its TTL lowered to the negative
+// caching TTL of RFC 2308, ready for the authority section of a negative
+// answer.
+func (zone *Zone) SOA() layers.DNSResourceRecord {
+	soa := zone.soa
+	if soa.SOA.Minimum < soa.TTL {
+		soa.TTL = soa.SOA.Minimum
+	}
+	return soa
+}
+
+// Contains reports whether name belongs under the apex of the zone.
+func (zone *Zone) Contains(name string) bool {
+	return isSubdomain(canonicalName(name), zone.Origin)
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func parentName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+func joinName(label string, name string) string {
+	if name == "" {
+		return label
+	}
+	return label + "." + name
+}
+
+func isSubdomain(child string, parent string) bool {
+	return parent == "" || child == parent || strings.HasSuffix(child, "."+parent)
+}
@@ -0,0 +1,113 @@
+package zones
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testZoneData = `$TTL 300
+@        3600 SOA ns hostmaster 1 7200 900 1209600 60
+@             NS  ns
+ns            A   192.0.2.53
+www           A   192.0.2.1
+*.wild        A   192.0.2.2
+a.b.empty     A   192.0.2.3
+child         NS  ns.child
+ns.child      A   192.0.2.54
+`
+
+func loadTestZone(t *testing.T, data string) (*Zone, error) {
+	dir := writeTestFiles(t, map[string]string{"zone": data})
+	return Load(filepath.Join(dir, "zone"), "Example.Test.")
+}
+
+func TestLoad(t *testing.T) {
+	zone, err := loadTestZone(t, testZoneData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone.Origin != "example.test" {
+		t.Errorf("got origin %q", zone.Origin)
+	}
+	if len(zone.Files) != 1 {
+		t.Errorf("got files %v", zone.Files)
+	}
+	if soa := zone.SOA(); soa.TTL != 60 {
+		t.Errorf("SOA TTL is %d instead of the negative TTL", soa.TTL)
+	}
+	if !zone.Exists("WWW.example.test.") || !zone.Exists("b.empty.example.test") {
+		t.Error("a name or an empty non-terminal doesn't exist")
+	}
+	if zone.Exists("missing.example.test") {
+		t.Error("a missing name exists")
+	}
+	if !zone.Contains("x.example.test") || zone.Contains("example.org") {
+		t.Error("Contains doesn't follow the apex")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	zone, err := loadTestZone(t, testZoneData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		found bool
+		owner string
+	}{
+		{"www.example.test", true, "www.example.test"},
+		{"x.wild.example.test", true, "x.wild.example.test"},
+		{"y.x.wild.example.test", true, "y.x.wild.example.test"},
+		// The parent of a wildcard is an empty non-terminal, and names
+		// under another existing name are not covered by it.
+		{"wild.example.test", true, ""},
+		{"x.www.example.test", false, ""},
+		{"b.empty.example.test", true, ""},
+	}
+	for _, test := range tests {
+		records, found := zone.Lookup(test.name)
+		if found != test.found {
+			t.Errorf("%s: got found %v", test.name, found)
+			continue
+		}
+		if test.owner != "" && (len(records) != 1 || string(records[0].Name) != test.owner) {
+			t.Errorf("%s: got records %v", test.name, records)
+		}
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	zone, err := loadTestZone(t, testZoneData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, cut := range map[string]string{
+		"child.example.test":      "child.example.test",
+		"host.child.example.test": "child.example.test",
+		"www.example.test":        "",
+		"example.test":            "",
+	} {
+		if got := zone.Delegation(name); got != cut {
+			t.Errorf("%s: got cut %q, want %q", name, got, cut)
+		}
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := map[string]string{
+		"without SOA":      "$TTL 300\n@ NS ns\n",
+		"two SOA records":  "$TTL 300\n@ SOA ns h 1 2 3 4 5\n@ SOA ns h 2 2 3 4 5\n",
+		"SOA below apex":   "$TTL 300\nsub SOA ns h 1 2 3 4 5\n",
+		"record elsewhere": testZoneData + "www.example.org. A 192.0.2.9\n",
+	}
+	for name, data := range tests {
+		if _, err := loadTestZone(t, data); err == nil {
+			t.Errorf("%s: the zone was loaded", name)
+		}
+	}
+	if _, err := loadTestZone(t, strings.Replace(testZoneData, "www ", "www.example.test. ", 1)); err != nil {
+		t.Errorf("an absolute name inside the zone was refused: %v", err)
+	}
+}